@@ -0,0 +1,97 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux && !386
+
+package gelf
+
+import (
+	"net"
+	"runtime"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is struct mmsghdr of sendmmsg(2).  Go pads it to the C size.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// batch holds the message headers for one sendmmsg call, pooled so
+// that sending chunks doesn't allocate them every time.
+type batch struct {
+	iovs []syscall.Iovec
+	msgs []mmsghdr
+}
+
+var batchPool = sync.Pool{
+	New: func() interface{} { return new(batch) },
+}
+
+// writeBatch sends the datagrams in bufs on conn, a connected socket,
+// with as few system calls as possible: sendmmsg(2) sends several at
+// once.  It returns how many were sent; on an error, the rest are
+// left to be sent one at a time, which also handles retries.
+// errNoBatch is returned for connections that aren't sockets.
+func writeBatch(conn net.Conn, bufs [][]byte) (int, error) {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return 0, errNoBatch
+	}
+	rc, err := sc.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+
+	b := batchPool.Get().(*batch)
+	defer batchPool.Put(b)
+	if cap(b.msgs) < len(bufs) {
+		b.iovs = make([]syscall.Iovec, len(bufs))
+		b.msgs = make([]mmsghdr, len(bufs))
+	}
+	iovs, msgs := b.iovs[:len(bufs)], b.msgs[:len(bufs)]
+	for i, buf := range bufs {
+		iovs[i] = syscall.Iovec{Base: &buf[0]}
+		iovs[i].SetLen(len(buf))
+		msgs[i] = mmsghdr{hdr: syscall.Msghdr{Iov: &iovs[i], Iovlen: 1}}
+	}
+
+	sent := 0
+	var errno syscall.Errno
+	err = rc.Write(func(fd uintptr) bool {
+		for sent < len(msgs) {
+			n, _, e := syscall.Syscall6(sysSendmmsg, fd,
+				uintptr(unsafe.Pointer(&msgs[sent])), uintptr(len(msgs)-sent), 0, 0, 0)
+			if e == syscall.EAGAIN {
+				// wait until the socket is writable
+				return false
+			}
+			if e == syscall.EINTR {
+				continue
+			}
+			if e != 0 {
+				errno = e
+				return true
+			}
+			sent += int(n)
+		}
+		return true
+	})
+	runtime.KeepAlive(bufs)
+
+	// drop the references to the chunks before pooling
+	for i := range iovs {
+		iovs[i] = syscall.Iovec{}
+		msgs[i] = mmsghdr{}
+	}
+	if err != nil {
+		return sent, err
+	}
+	if errno != 0 {
+		return sent, errno
+	}
+	return sent, nil
+}
@@ -0,0 +1,9 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+// sysSendmmsg is the number of sendmmsg(2), which package syscall
+// doesn't define for amd64.
+const sysSendmmsg = 307
@@ -0,0 +1,15 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !linux || 386
+
+package gelf
+
+import "net"
+
+// writeBatch would send several datagrams per system call, which takes
+// sendmmsg(2); without it, chunks are sent one at a time.
+func writeBatch(conn net.Conn, bufs [][]byte) (int, error) {
+	return 0, errNoBatch
+}
@@ -0,0 +1,12 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build linux && !386 && !amd64
+
+package gelf
+
+import "syscall"
+
+// sysSendmmsg is the number of sendmmsg(2).
+const sysSendmmsg = syscall.SYS_SENDMMSG
@@ -0,0 +1,80 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash/crc32"
+)
+
+// ChecksumField is the additional field holding the checksum of the
+// full message, see Writer.Checksum.
+const ChecksumField = "_checksum"
+
+// ChecksumType is the algorithm a Writer uses to checksum full
+// messages.
+type ChecksumType int
+
+const (
+	// ChecksumNone sends no checksum.
+	ChecksumNone ChecksumType = iota
+	// ChecksumCRC32 sends the IEEE CRC-32 of the full message as 8
+	// hex digits.  It is cheap, costing about as much as copying the
+	// message, and catches truncation and corruption, but not
+	// deliberate tampering.
+	ChecksumCRC32
+	// ChecksumSHA256 sends the SHA-256 of the full message as 64 hex
+	// digits.  It is several times slower than CRC-32, which matters
+	// for large messages at high rates.
+	ChecksumSHA256
+)
+
+// String returns the name of the checksum type.
+func (t ChecksumType) String() string {
+	switch t {
+	case ChecksumNone:
+		return "none"
+	case ChecksumCRC32:
+		return "crc32"
+	case ChecksumSHA256:
+		return "sha256"
+	}
+	return fmt.Sprintf("ChecksumType(%d)", int(t))
+}
+
+// Sum returns the checksum of s, as a Writer sends it, so that a
+// collector can compare it to the ChecksumField of a message.  It
+// returns "" for ChecksumNone and unknown types.
+func (t ChecksumType) Sum(s string) string {
+	switch t {
+	case ChecksumCRC32:
+		sum := crc32.ChecksumIEEE([]byte(s))
+		return fmt.Sprintf("%08x", sum)
+	case ChecksumSHA256:
+		sum := sha256.Sum256([]byte(s))
+		return hex.EncodeToString(sum[:])
+	}
+	return ""
+}
+
+// VerifyChecksum reports whether the full message of m matches the
+// checksum in its ChecksumField, guessing the algorithm from the
+// length of the checksum.  Messages without a full message or a
+// checksum don't verify, nor do those sent with a FieldPrefix.
+func VerifyChecksum(m *Message) bool {
+	sum, ok := m.Extra[ChecksumField].(string)
+	if !ok || m.Full == "" {
+		return false
+	}
+	switch len(sum) {
+	case 8:
+		return ChecksumCRC32.Sum(m.Full) == sum
+	case 64:
+		return ChecksumSHA256.Sum(m.Full) == sum
+	}
+	return false
+}
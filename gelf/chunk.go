@@ -0,0 +1,65 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"fmt"
+)
+
+// Chunk splits a (possibly compressed) payload into GELF chunk
+// datagrams of at most chunkSize bytes each, for sending it over a
+// transport of one's own.  The format is documented at
+// http://docs.graylog.org/en/2.1/pages/gelf.html as:
+//
+//	2-byte magic (0x1e 0x0f), 8 byte id, 1 byte sequence id, 1 byte
+//	total, chunk-data
+//
+// so every chunk starts with a 12 byte header:
+//
+//	offset  length  field
+//	0       2       magic bytes 0x1e 0x0f
+//	2       8       message id, identical for all chunks of a message
+//	10      1       sequence number, starting at 0
+//	11      1       total number of chunks, at most 128
+//
+// messageID must be 8 bytes long and unique per message.  The payload is
+// chunked even if it would fit into a single datagram, and an error is
+// returned if it would need more than 128 chunks.  The datagrams share
+// one backing array.
+func Chunk(messageID []byte, payload []byte, chunkSize int) ([][]byte, error) {
+	if len(messageID) != 8 {
+		return nil, fmt.Errorf("got %d byte message id, need 8", len(messageID))
+	}
+	dataLen := chunkSize - chunkedHeaderLen
+	if dataLen <= 0 {
+		return nil, fmt.Errorf("chunk size %d leaves no room for data", chunkSize)
+	}
+	nChunks := (len(payload) + dataLen - 1) / dataLen
+	if nChunks == 0 {
+		nChunks = 1
+	}
+	if nChunks > maxChunks {
+		return nil, fmt.Errorf("msg too large, would need %d chunks", nChunks)
+	}
+
+	buf := make([]byte, 0, len(payload)+nChunks*chunkedHeaderLen)
+	chunks := make([][]byte, 0, nChunks)
+	for i := 0; i < nChunks; i++ {
+		off := len(buf)
+		// the spec only deals in individual bytes, so there is no
+		// byte order to care about
+		buf = append(buf, magicChunked...)
+		buf = append(buf, messageID...)
+		buf = append(buf, byte(i), byte(nChunks))
+
+		data := payload[i*dataLen:]
+		if len(data) > dataLen {
+			data = data[:dataLen]
+		}
+		buf = append(buf, data...)
+		chunks = append(chunks, buf[off:len(buf):len(buf)])
+	}
+	return chunks, nil
+}
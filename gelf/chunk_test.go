@@ -0,0 +1,61 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChunk(t *testing.T) {
+	id := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	payload := bytes.Repeat([]byte("0123456789"), 25)
+
+	// 250 bytes in chunks of 100, 88 of them data
+	chunks, err := Chunk(id, payload, 100)
+	if err != nil {
+		t.Errorf("Chunk: %s", err)
+		return
+	}
+	if len(chunks) != 3 {
+		t.Errorf("expected 3 chunks, got %d", len(chunks))
+		return
+	}
+
+	var data []byte
+	for seq, chunk := range chunks {
+		if len(chunk) > 100 {
+			t.Errorf("chunk %d: %d bytes exceed the chunk size", seq, len(chunk))
+		}
+		if !bytes.Equal(chunk[:2], []byte{0x1e, 0x0f}) {
+			t.Errorf("chunk %d: bad magic %v", seq, chunk[:2])
+		}
+		if !bytes.Equal(chunk[2:10], id) {
+			t.Errorf("chunk %d: expected id %v, got %v", seq, id, chunk[2:10])
+		}
+		if chunk[10] != byte(seq) || chunk[11] != 3 {
+			t.Errorf("chunk %d: expected sequence %d/3, got %d/%d", seq, seq, chunk[10], chunk[11])
+		}
+		data = append(data, chunk[12:]...)
+	}
+	if !bytes.Equal(data, payload) {
+		t.Errorf("chunk data doesn't add up to the payload: %q", data)
+	}
+
+	// a payload filling the chunks exactly has no empty chunk
+	if chunks, err = Chunk(id, payload[:176], 100); err != nil || len(chunks) != 2 {
+		t.Errorf("expected 2 chunks, got %d (%v)", len(chunks), err)
+	}
+
+	if _, err = Chunk(id, make([]byte, 129*88), 100); err == nil {
+		t.Errorf("Chunk into 129 chunks didn't fail")
+	}
+	if _, err = Chunk(id[:3], payload, 100); err == nil {
+		t.Errorf("Chunk with a 3 byte message id didn't fail")
+	}
+	if _, err = Chunk(id, payload, chunkedHeaderLen); err == nil {
+		t.Errorf("Chunk without room for data didn't fail")
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"context"
+	"time"
+)
+
+// writerKey is the context key for the Writer of NewContext.
+type writerKey struct{}
+
+// startKey is the context key for the time of WithRequestStart.
+type startKey struct{}
+
+// NewContext returns a copy of ctx carrying w, for middleware to hand a
+// request-scoped Writer down to the handlers, which get it back with
+// FromContext.
+func NewContext(ctx context.Context, w *Writer) context.Context {
+	return context.WithValue(ctx, writerKey{}, w)
+}
+
+// FromContext returns the Writer stored in ctx by NewContext, if any.
+func FromContext(ctx context.Context) (*Writer, bool) {
+	w, ok := ctx.Value(writerKey{}).(*Writer)
+	return w, ok && w != nil
+}
+
+// WithRequestStart returns a copy of ctx carrying start as the time the
+// request it belongs to started, for WriteMessageContext to add the
+// start and the time elapsed since to messages.
+func WithRequestStart(ctx context.Context, start time.Time) context.Context {
+	return context.WithValue(ctx, startKey{}, start)
+}
+
+// RequestStart returns the start time stored in ctx by
+// WithRequestStart, if any.
+func RequestStart(ctx context.Context) (time.Time, bool) {
+	start, ok := ctx.Value(startKey{}).(time.Time)
+	return start, ok
+}
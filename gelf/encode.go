@@ -0,0 +1,141 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"unicode/utf8"
+)
+
+// The standard fields of a message are encoded by hand rather than
+// with encoding/json, which would allocate for every message.  The
+// output is the same as json.Marshal produces for them.  Only Extra
+// still goes through encoding/json, so a message without Extra, sent
+// uncompressed, is encoded and written without any allocation.
+
+// writeJSONString writes s as a JSON string, escaped the way
+// encoding/json does it, including the escaping of HTML characters.
+func writeJSONString(buf *bytes.Buffer, s string) {
+	const hex = "0123456789abcdef"
+
+	buf.WriteByte('"')
+	start := 0
+	for i := 0; i < len(s); {
+		if b := s[i]; b < utf8.RuneSelf {
+			if b >= 0x20 && b != '"' && b != '\\' && b != '<' && b != '>' && b != '&' {
+				i++
+				continue
+			}
+			buf.WriteString(s[start:i])
+			switch b {
+			case '\\', '"':
+				buf.WriteByte('\\')
+				buf.WriteByte(b)
+			case '\n':
+				buf.WriteString(`\n`)
+			case '\r':
+				buf.WriteString(`\r`)
+			case '\t':
+				buf.WriteString(`\t`)
+			default:
+				buf.WriteString(`\u00`)
+				buf.WriteByte(hex[b>>4])
+				buf.WriteByte(hex[b&0xf])
+			}
+			i++
+			start = i
+			continue
+		}
+		c, size := utf8.DecodeRuneInString(s[i:])
+		if c == utf8.RuneError && size == 1 {
+			buf.WriteString(s[start:i])
+			buf.WriteString("\ufffd")
+			i += size
+			start = i
+			continue
+		}
+		// U+2028 and U+2029 are valid JSON but break JavaScript
+		if c == '\u2028' || c == '\u2029' {
+			buf.WriteString(s[start:i])
+			buf.WriteString(`\u202`)
+			buf.WriteByte(hex[c&0xf])
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+	buf.WriteString(s[start:])
+	buf.WriteByte('"')
+}
+
+// writeJSONFloat writes f as a JSON number, formatted the way
+// encoding/json does it.
+func writeJSONFloat(buf *bytes.Buffer, f float64) error {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return fmt.Errorf("json: unsupported value: %s", strconv.FormatFloat(f, 'g', -1, 64))
+	}
+
+	format := byte('f')
+	if abs := math.Abs(f); abs != 0 && (abs < 1e-6 || abs >= 1e21) {
+		format = 'e'
+	}
+	var scratch [32]byte
+	b := strconv.AppendFloat(scratch[:0], f, format, -1, 64)
+	if format == 'e' {
+		// clean up e-09 to e-9
+		n := len(b)
+		if n >= 4 && b[n-4] == 'e' && b[n-3] == '-' && b[n-2] == '0' {
+			b[n-2] = b[n-1]
+			b = b[:n-1]
+		}
+	}
+	buf.Write(b)
+	return nil
+}
+
+// writeJSONKey writes the separator and key of a standard field: key,
+// such as `,"level":`, if name is empty, or name otherwise.
+func writeJSONKey(buf *bytes.Buffer, key, name string) {
+	if name == "" {
+		buf.WriteString(key)
+		return
+	}
+	buf.WriteByte(',')
+	writeJSONString(buf, name)
+	buf.WriteByte(':')
+}
+
+// writeJSONFields writes the standard fields of m, without the
+// enclosing braces, with the names overridden by names.
+func (m *Message) writeJSONFields(buf *bytes.Buffer, names StandardFields) error {
+	buf.WriteString(`"version":`)
+	writeJSONString(buf, m.Version)
+	buf.WriteString(`,"host":`)
+	writeJSONString(buf, m.Host)
+	writeJSONKey(buf, `,"short_message":`, names.Short)
+	writeJSONString(buf, m.Short)
+	if m.Full != "" {
+		writeJSONKey(buf, `,"full_message":`, names.Full)
+		writeJSONString(buf, m.Full)
+	}
+	writeJSONKey(buf, `,"timestamp":`, names.Timestamp)
+	if err := writeJSONFloat(buf, m.TimeUnix); err != nil {
+		return err
+	}
+	if m.Level != 0 {
+		var scratch [16]byte
+		writeJSONKey(buf, `,"level":`, names.Level)
+		buf.Write(strconv.AppendInt(scratch[:0], int64(m.Level), 10))
+	}
+	if m.Facility != "" {
+		buf.WriteString(`,"facility":`)
+		writeJSONString(buf, m.Facility)
+	}
+	return nil
+}
@@ -0,0 +1,18 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !race
+
+package gelf
+
+import "testing"
+
+// tests that sending uncompressed messages without Extra doesn't
+// allocate; not under the race detector, which allocates on its own
+func TestWriteMessageNoAllocs(t *testing.T) {
+	w, m := newNoAllocsWriter(t)
+	if allocs := testing.AllocsPerRun(100, func() { w.WriteMessage(m) }); allocs > 0 {
+		t.Errorf("expected no allocations, got %v per message", allocs)
+	}
+}
@@ -0,0 +1,170 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+	"testing"
+)
+
+// tests that the standard fields are encoded like encoding/json does
+func TestMarshalJSONBufStandardFields(t *testing.T) {
+	messages := []Message{
+		{},
+		{Version: "1.1", Host: "h", Short: "short", TimeUnix: 1500000000},
+		{Version: "1.1", Host: "h", Short: "s", Full: "full\nmessage\twith \"quotes\" and \\", TimeUnix: 1500000000.123456, Level: LOG_ERR, Facility: "f"},
+		{Short: "<html> & \x00\x1f\x7f", TimeUnix: 1e-7},
+		{Short: "unicode \u00fc \u20ac \U0001f600 \u2028 \u2029", TimeUnix: 1e21},
+		{Short: "invalid \xff utf-8 \xe2\x82", TimeUnix: -0.5, Level: -1},
+	}
+
+	for _, m := range messages {
+		expected, err := json.Marshal(m)
+		if err != nil {
+			t.Errorf("json.Marshal: %s", err)
+			return
+		}
+
+		var buf bytes.Buffer
+		if err = m.MarshalJSONBuf(&buf); err != nil {
+			t.Errorf("MarshalJSONBuf: %s", err)
+			return
+		}
+		if !bytes.Equal(buf.Bytes(), expected) {
+			t.Errorf("expected %s, got %s", expected, buf.Bytes())
+		}
+	}
+
+	var buf bytes.Buffer
+	m := Message{TimeUnix: math.NaN()}
+	if err := m.MarshalJSONBuf(&buf); err == nil {
+		t.Errorf("MarshalJSONBuf of a NaN timestamp didn't fail")
+	}
+}
+
+// tests that a "_level" in Extra doesn't conflict with the level field
+func TestMarshalJSONBufStripsLevel(t *testing.T) {
+	m := Message{
+		Short: "leveled",
+		Level: LOG_WARNING,
+		Extra: map[string]interface{}{"_level": "warn", "_user": "alice"},
+	}
+
+	var buf bytes.Buffer
+	if err := m.MarshalJSONBuf(&buf); err != nil {
+		t.Errorf("MarshalJSONBuf: %s", err)
+		return
+	}
+	expected := `{"version":"","host":"","short_message":"leveled","timestamp":0,"level":4,"_user":"alice"}`
+	if buf.String() != expected {
+		t.Errorf("expected %s, got %s", expected, buf.String())
+	}
+	if m.Extra["_level"] != "warn" {
+		t.Errorf("MarshalJSONBuf modified the message: %v", m.Extra)
+	}
+}
+
+// tests that compressed output only depends on the message
+func TestCompressDeterministic(t *testing.T) {
+	m := Message{Version: "1.1", Host: "h", Short: "again", TimeUnix: 1500000000}
+	for _, ctype := range []CompressType{CompressGzip, CompressZlib} {
+		var first []byte
+		for i := 0; i < 2; i++ {
+			mBuf, zBuf := new(bytes.Buffer), new(bytes.Buffer)
+			zBytes, err := m.encode(mBuf, zBuf, ctype, flate.BestSpeed, AutoCompression{}, StandardFields{})
+			if err != nil {
+				t.Errorf("encode: %s", err)
+				return
+			}
+			if i == 0 {
+				first = zBytes
+			} else if !bytes.Equal(zBytes, first) {
+				t.Errorf("%s: %x differs from %x", ctype, zBytes, first)
+			}
+		}
+		if ctype == CompressGzip && (binary.LittleEndian.Uint32(first[4:8]) != 0 || first[9] != 255) {
+			t.Errorf("gzip header has mtime %x and OS %d", first[4:8], first[9])
+		}
+	}
+}
+
+// measures sending uncompressed messages without Extra
+func BenchmarkWriteMessageNoAllocs(b *testing.B) {
+	w, m := newNoAllocsWriter(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.WriteMessage(m)
+	}
+}
+
+// newNoAllocsWriter returns an uncompressing writer and a message
+// without Extra for it.  The datagrams are discarded without decoding
+// them, so that only the allocations of the writer are counted.
+func newNoAllocsWriter(tb testing.TB) (*Writer, *Message) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("ListenPacket: %s", err)
+	}
+	tb.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, ChunkSize)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	w, err := NewWriter(conn.LocalAddr().String(), "")
+	if err != nil {
+		tb.Fatalf("NewWriter: %s", err)
+	}
+	w.CompressionType = CompressNone
+
+	m := &Message{
+		Version:  "1.1",
+		Host:     w.hostname,
+		Short:    "short message",
+		Full:     "full message",
+		TimeUnix: 1500000000,
+		Level:    6, // info
+		Facility: w.Facility,
+		RawExtra: json.RawMessage(`{"_file":"1234","_line": "3456"}`),
+	}
+	return w, m
+}
+
+// compares the compression types across message sizes, reporting the
+// bytes sent per message
+func BenchmarkCompression(b *testing.B) {
+	for _, size := range []int{256, 4 << 10, 128 << 10} {
+		m := Message{
+			Version: "1.1",
+			Host:    "h",
+			Short:   "benchmark",
+			Full:    strings.Repeat("lorem ipsum dolor sit amet ", size/27),
+		}
+		for _, ctype := range []CompressType{CompressNone, CompressGzip, CompressAuto} {
+			b.Run(fmt.Sprintf("%d/%s", size, ctype), func(b *testing.B) {
+				var n int
+				for i := 0; i < b.N; i++ {
+					var err error
+					if n, err = m.EstimatedSize(ctype, flate.BestSpeed); err != nil {
+						b.Fatalf("EstimatedSize: %s", err)
+					}
+				}
+				b.ReportMetric(float64(n), "bytes/msg")
+			})
+		}
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+
+package gelf
+
+import "syscall"
+
+// The errors of a full socket buffer, see isRetryable.
+var (
+	errWouldBlock error = syscall.EAGAIN
+	errNoBuffers  error = syscall.ENOBUFS
+)
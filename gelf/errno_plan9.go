@@ -0,0 +1,14 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import "errors"
+
+// The errors of a full socket buffer, see isRetryable.  Plan 9 has no
+// such errnos, so these are never returned.
+var (
+	errWouldBlock = errors.New("resource temporarily unavailable")
+	errNoBuffers  = errors.New("no buffer space available")
+)
@@ -0,0 +1,50 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package gelfexpvar publishes the counters of a gelf.Reader as expvar
+// variables, to be scraped from /debug/vars without further
+// dependencies.  It is kept separate from package gelf because
+// importing expvar registers /debug/vars on http.DefaultServeMux.
+package gelfexpvar
+
+import (
+	"expvar"
+	"fmt"
+
+	"github.com/nimbusec-oss/go-gelf/gelf"
+)
+
+// PublishReader publishes the counters of r as an expvar map named
+// namespace, with the fields of gelf.ReaderStats in snake case, such as
+// "bad_datagrams", and "pending_messages", the number of chunked
+// messages being reassembled.
+//
+// The values are read when /debug/vars is requested.  expvar variables
+// can't be unpublished, so publish every Reader under its own
+// namespace; PublishReader fails if namespace is already taken.
+func PublishReader(namespace string, r *gelf.Reader) error {
+	if expvar.Get(namespace) != nil {
+		return fmt.Errorf("expvar %q already published", namespace)
+	}
+
+	m := new(expvar.Map).Init()
+	stat := func(name string, f func(gelf.ReaderStats) uint64) {
+		m.Set(name, expvar.Func(func() interface{} {
+			return f(r.Stats())
+		}))
+	}
+	stat("datagrams", func(s gelf.ReaderStats) uint64 { return s.Datagrams })
+	stat("chunks", func(s gelf.ReaderStats) uint64 { return s.Chunks })
+	stat("reassembled", func(s gelf.ReaderStats) uint64 { return s.Reassembled })
+	stat("messages", func(s gelf.ReaderStats) uint64 { return s.Messages })
+	stat("dropped", func(s gelf.ReaderStats) uint64 { return s.Dropped })
+	stat("bad_datagrams", func(s gelf.ReaderStats) uint64 { return s.BadDatagrams })
+	stat("decode_errors", func(s gelf.ReaderStats) uint64 { return s.DecodeErrors })
+	stat("duplicates", func(s gelf.ReaderStats) uint64 { return s.Duplicates })
+	m.Set("pending_messages", expvar.Func(func() interface{} {
+		return len(r.PendingChunks())
+	}))
+	expvar.Publish(namespace, m)
+	return nil
+}
@@ -0,0 +1,66 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelfexpvar
+
+import (
+	"encoding/json"
+	"expvar"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/nimbusec-oss/go-gelf/gelf"
+)
+
+func TestPublishReader(t *testing.T) {
+	r, err := gelf.NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	if err = PublishReader("gelf_test", r); err != nil {
+		t.Errorf("PublishReader: %s", err)
+		return
+	}
+	if err = PublishReader("gelf_test", r); err == nil {
+		t.Errorf("PublishReader of a taken namespace didn't fail")
+	}
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+	// a short datagram, a malformed chunk and a plain message
+	for _, d := range []string{"x", "\x1e\x0fshort", `{"version":"1.1","host":"h","short_message":"ok"}`} {
+		if _, err = conn.Write([]byte(d)); err != nil {
+			t.Errorf("Write: %s", err)
+			return
+		}
+	}
+	if _, err = r.ReadMessageTimeout(time.Second); err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+
+	var vars struct {
+		Datagrams       uint64 `json:"datagrams"`
+		Messages        uint64 `json:"messages"`
+		Dropped         uint64 `json:"dropped"`
+		BadDatagrams    uint64 `json:"bad_datagrams"`
+		PendingMessages int    `json:"pending_messages"`
+	}
+	if err = json.Unmarshal([]byte(expvar.Get("gelf_test").String()), &vars); err != nil {
+		t.Errorf("json.Unmarshal: %s", err)
+		return
+	}
+	if vars.Datagrams != 3 || vars.Messages != 1 || vars.BadDatagrams != 2 ||
+		vars.Dropped != 0 || vars.PendingMessages != 0 {
+		t.Errorf("unexpected vars %+v", vars)
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package gelfotel correlates GELF messages with OpenTelemetry traces.
+// It is kept separate from package gelf so that only programs using
+// OpenTelemetry depend on it.
+//
+// To attach the active trace and span ids to every message written
+// with WriteMessageContext, set
+//
+//	w.TraceFunc = gelfotel.TraceFunc
+package gelfotel
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
+)
+
+// TraceFunc returns the hex encoded trace and span id of the span
+// context in ctx, or empty strings if there is none.  It is meant to be
+// used as gelf.Writer.TraceFunc.
+func TraceFunc(ctx context.Context) (traceID, spanID string) {
+	sc := trace.SpanContextFromContext(ctx)
+	if !sc.IsValid() {
+		return "", ""
+	}
+	return sc.TraceID().String(), sc.SpanID().String()
+}
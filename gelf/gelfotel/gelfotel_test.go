@@ -0,0 +1,57 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelfotel
+
+import (
+	"context"
+	"testing"
+
+	"github.com/nimbusec-oss/go-gelf/gelf"
+	"github.com/nimbusec-oss/go-gelf/gelf/gelftest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+func TestTraceFunc(t *testing.T) {
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	ctx := trace.ContextWithSpanContext(context.Background(), trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID: traceID,
+		SpanID:  spanID,
+	}))
+
+	w, r, cleanup, err := gelftest.Loopback()
+	if err != nil {
+		t.Errorf("Loopback: %s", err)
+		return
+	}
+	defer cleanup()
+	w.TraceFunc = TraceFunc
+
+	for _, ctx := range []context.Context{ctx, context.Background()} {
+		m := gelf.Message{Version: "1.1", Host: "fake-host", Short: "traced"}
+		if err = w.WriteMessageContext(ctx, &m); err != nil {
+			t.Errorf("WriteMessageContext: %s", err)
+			return
+		}
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Extra[gelf.TraceIDField] != traceID.String() || msg.Extra[gelf.SpanIDField] != spanID.String() {
+		t.Errorf("span ids not attached: %v", msg.Extra)
+	}
+
+	msg, err = r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if _, ok := msg.Extra[gelf.TraceIDField]; ok {
+		t.Errorf("trace id attached without a span: %v", msg.Extra)
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+// Package gelftest provides utilities for testing code that logs
+// through package gelf.
+package gelftest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nimbusec-oss/go-gelf/gelf"
+)
+
+// Loopback returns a Writer sending to a Reader listening on a fresh
+// local port, so that tests can read back what they log.  cleanup
+// closes both ends.
+func Loopback() (w *gelf.Writer, r *gelf.Reader, cleanup func(), err error) {
+	r, err = gelf.NewReader("127.0.0.1:0")
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("NewReader: %s", err)
+	}
+
+	w, err = gelf.NewWriter(r.Addr(), "")
+	if err != nil {
+		r.Close()
+		return nil, nil, nil, fmt.Errorf("NewWriter: %s", err)
+	}
+
+	cleanup = func() {
+		w.Close()
+		r.Close()
+	}
+	return w, r, cleanup, nil
+}
+
+// ChunkedLoopback is like Loopback, but the Writer splits every message
+// larger than chunkSize bytes into chunks, uses SequentialIDs and
+// doesn't compress, so that even small messages take the chunking path
+// and produce the same datagrams in every run.
+func ChunkedLoopback(chunkSize int) (w *gelf.Writer, r *gelf.Reader, cleanup func(), err error) {
+	w, r, cleanup, err = Loopback()
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	w.ChunkSize = chunkSize
+	w.MessageIDFunc = SequentialIDs()
+	w.CompressionType = gelf.CompressNone
+	return w, r, cleanup, nil
+}
+
+// SequentialIDs returns a Writer.MessageIDFunc generating the message
+// ids 1, 2, 3 and so on, as 8 byte big endian numbers.
+func SequentialIDs() func() ([]byte, error) {
+	var n uint64
+	return func() ([]byte, error) {
+		id := make([]byte, 8)
+		binary.BigEndian.PutUint64(id, atomic.AddUint64(&n, 1))
+		return id, nil
+	}
+}
+
+// FixedClock returns a Writer.TimeFunc that always returns t.
+func FixedClock(t time.Time) func() time.Time {
+	return func() time.Time {
+		return t
+	}
+}
+
+// RoundTrip sends m through w and reads it back from r.  It returns an
+// error unless the message read has the standard fields of m and every
+// field in its Extra with the same value, as far as JSON tells.  Fields
+// added by the Writer are ignored.
+func RoundTrip(w *gelf.Writer, r *gelf.Reader, m *gelf.Message) error {
+	if err := w.WriteMessage(m); err != nil {
+		return fmt.Errorf("WriteMessage: %s", err)
+	}
+	got, err := r.ReadMessage()
+	if err != nil {
+		return fmt.Errorf("ReadMessage: %s", err)
+	}
+
+	if got.Version != m.Version || (m.Host != "" && got.Host != m.Host) ||
+		got.Short != m.Short || got.Full != m.Full ||
+		got.TimeUnix != m.TimeUnix || got.Level != m.Level ||
+		got.Facility != m.Facility {
+		return fmt.Errorf("sent %+v, got %+v", *m, *got)
+	}
+	for k, v := range m.Extra {
+		expected, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Errorf("json.Marshal(%s): %s", k, err)
+		}
+		actual, _ := json.Marshal(got.Extra[k])
+		if _, ok := got.Extra[k]; !ok || !bytes.Equal(actual, expected) {
+			return fmt.Errorf("field %s: sent %s, got %s", k, expected, actual)
+		}
+	}
+	return nil
+}
+
+// MessageWriter is what sends messages, such as a *gelf.Writer or a
+// *gelf.StreamWriter.
+type MessageWriter interface {
+	WriteMessage(m *gelf.Message) error
+}
+
+// ErrInjected is the error a FaultyWriter fails writes with.
+var ErrInjected = errors.New("gelftest: injected failure")
+
+// FaultyWriter wraps a MessageWriter and fails some of the writes with
+// ErrInjected instead of passing them on, to test how code copes with
+// logging failures.
+type FaultyWriter struct {
+	// Policy, when set, decides which writes fail instead of the
+	// failEvery passed to NewFaultyWriter: it is called with the
+	// number of the write, counting from 1, and the message.
+	Policy func(n int, m *gelf.Message) bool
+
+	inner     MessageWriter
+	failEvery int
+
+	mu     sync.Mutex
+	n      int
+	failed []*gelf.Message
+}
+
+// NewFaultyWriter returns a FaultyWriter failing every failEvery-th
+// write to inner, or none if failEvery is 0.
+func NewFaultyWriter(inner MessageWriter, failEvery int) *FaultyWriter {
+	return &FaultyWriter{inner: inner, failEvery: failEvery}
+}
+
+// WriteMessage passes m on to the wrapped writer, or fails with
+// ErrInjected and records m.  It is safe for concurrent use if the
+// wrapped writer is.
+func (f *FaultyWriter) WriteMessage(m *gelf.Message) error {
+	f.mu.Lock()
+	f.n++
+	var fail bool
+	if f.Policy != nil {
+		fail = f.Policy(f.n, m)
+	} else {
+		fail = f.failEvery > 0 && f.n%f.failEvery == 0
+	}
+	if fail {
+		f.failed = append(f.failed, m)
+	}
+	f.mu.Unlock()
+
+	if fail {
+		return ErrInjected
+	}
+	return f.inner.WriteMessage(m)
+}
+
+// Failed returns the messages failed so far, in order.
+func (f *FaultyWriter) Failed() []*gelf.Message {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]*gelf.Message(nil), f.failed...)
+}
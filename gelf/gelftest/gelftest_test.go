@@ -0,0 +1,124 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelftest
+
+import (
+	"bytes"
+	"log"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nimbusec-oss/go-gelf/gelf"
+)
+
+func TestLoopback(t *testing.T) {
+	w, r, cleanup, err := Loopback()
+	if err != nil {
+		t.Errorf("Loopback: %s", err)
+		return
+	}
+	defer cleanup()
+
+	log.New(w, "", 0).Print("hello loopback")
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "hello loopback" {
+		t.Errorf("msg.Short: expected hello loopback, got %s", msg.Short)
+	}
+}
+
+// tests that a large message round-trips through chunking
+func TestChunkedRoundTrip(t *testing.T) {
+	w, r, cleanup, err := ChunkedLoopback(100)
+	if err != nil {
+		t.Errorf("ChunkedLoopback: %s", err)
+		return
+	}
+	defer cleanup()
+	if err = w.ValidateConfig(); err != nil {
+		t.Errorf("ValidateConfig: %s", err)
+		return
+	}
+	w.TimeFunc = FixedClock(time.Unix(1500000000, 0))
+
+	m := &gelf.Message{
+		Version:  "1.1",
+		Host:     "fake-host",
+		Short:    "chunked",
+		Full:     strings.Repeat("full message ", 500),
+		TimeUnix: 1500000000,
+		Level:    gelf.LOG_INFO,
+		Extra:    map[string]interface{}{"_count": 3, "_user": "alice"},
+	}
+	if err = RoundTrip(w, r, m); err != nil {
+		t.Errorf("RoundTrip: %s", err)
+		return
+	}
+	if len(r.PendingChunks()) != 0 || r.Dropped() != 0 {
+		t.Errorf("chunks left behind: %v, %d dropped", r.PendingChunks(), r.Dropped())
+	}
+
+	if _, err = w.Write([]byte("stamped")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.TimeUnix != 1500000000 {
+		t.Errorf("expected the fixed timestamp, got %f", msg.TimeUnix)
+	}
+}
+
+func TestSequentialIDs(t *testing.T) {
+	ids := SequentialIDs()
+	for i := byte(1); i <= 3; i++ {
+		id, err := ids()
+		if err != nil || !bytes.Equal(id, []byte{0, 0, 0, 0, 0, 0, 0, i}) {
+			t.Errorf("id %d: got %v, %v", i, id, err)
+		}
+	}
+}
+
+func TestFaultyWriter(t *testing.T) {
+	var buf bytes.Buffer
+	f := NewFaultyWriter(gelf.NewStreamWriter(&buf), 3)
+
+	var failed []string
+	for i := 1; i <= 7; i++ {
+		m := &gelf.Message{Version: "1.1", Host: "h", Short: strings.Repeat("x", i)}
+		if err := f.WriteMessage(m); err == ErrInjected {
+			failed = append(failed, m.Short)
+		} else if err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+	}
+	if len(failed) != 2 || failed[0] != "xxx" || failed[1] != "xxxxxx" {
+		t.Errorf("expected writes 3 and 6 to fail, got %q", failed)
+	}
+	if recorded := f.Failed(); len(recorded) != 2 || recorded[0].Short != "xxx" {
+		t.Errorf("unexpected failed messages %v", recorded)
+	}
+	if n := bytes.Count(buf.Bytes(), []byte{0}); n != 5 {
+		t.Errorf("expected 5 messages passed on, got %d", n)
+	}
+
+	f = NewFaultyWriter(gelf.NewStreamWriter(&buf), 0)
+	f.Policy = func(n int, m *gelf.Message) bool { return m.Level == gelf.LOG_ERR }
+	if err := f.WriteMessage(&gelf.Message{Short: "info", Level: gelf.LOG_INFO}); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+	}
+	if err := f.WriteMessage(&gelf.Message{Short: "error", Level: gelf.LOG_ERR}); err != ErrInjected {
+		t.Errorf("expected ErrInjected, got %v", err)
+	}
+}
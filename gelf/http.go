@@ -0,0 +1,87 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+)
+
+// LevelFromHTTPStatus maps an HTTP status code to the severity of the
+// access log message of the response: 5xx is LOG_ERR, 4xx LOG_WARNING
+// and the rest LOG_INFO.  It is a LevelMapper, so see HTTPStatusLevels
+// for other thresholds.
+func LevelFromHTTPStatus(code int) int32 {
+	switch {
+	case code >= 500:
+		return LOG_ERR
+	case code >= 400:
+		return LOG_WARNING
+	}
+	return LOG_INFO
+}
+
+// HTTPStatusLevels returns a LevelMapper mapping HTTP status codes by
+// thresholds: a code gets the level of the greatest key in levels not
+// above it, and LOG_INFO if there is none.  LevelFromHTTPStatus is
+// HTTPStatusLevels(map[int]int32{400: LOG_WARNING, 500: LOG_ERR}); add
+// 404: LOG_INFO, 405: LOG_WARNING to that to not warn about missing
+// pages, for instance.  levels is copied, so changing it afterwards
+// doesn't change the mapping.
+func HTTPStatusLevels(levels map[int]int32) LevelMapper {
+	codes := make([]int, 0, len(levels))
+	for code := range levels {
+		codes = append(codes, code)
+	}
+	sort.Ints(codes)
+	mapped := make([]int32, len(codes))
+	for i, code := range codes {
+		mapped[i] = levels[code]
+	}
+
+	return func(code int) int32 {
+		i := sort.SearchInts(codes, code+1)
+		if i == 0 {
+			return LOG_INFO
+		}
+		return mapped[i-1]
+	}
+}
+
+// RecoveryMiddleware returns a middleware recovering from panics in the
+// handlers it wraps.  A panic is sent through w as a LOG_EMERG message
+// with the panic value as short message, the stack trace in the _stack
+// field and the method, URL and remote address of the request, before
+// the client gets a 500 Internal Server Error.  The Writer sends
+// synchronously, so the message is on its way even if the process dies
+// right after.  http.ErrAbortHandler, which net/http uses to abort a
+// response silently, is passed on.
+func RecoveryMiddleware(w *Writer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+			defer func() {
+				v := recover()
+				if v == nil {
+					return
+				}
+				if v == http.ErrAbortHandler {
+					panic(v)
+				}
+
+				m := w.newMessage(LOG_EMERG, fmt.Sprintf("panic: %v", v), "", "", 0)
+				m.Extra[w.ownField("_stack")] = string(debug.Stack())
+				m.Extra[w.ownField("_http_method")] = req.Method
+				m.Extra[w.ownField("_http_url")] = req.URL.String()
+				m.Extra[w.ownField("_remote_addr")] = req.RemoteAddr
+				w.WriteMessage(m)
+
+				http.Error(rw, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}()
+			next.ServeHTTP(rw, req)
+		})
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPStatusLevels(t *testing.T) {
+	custom := HTTPStatusLevels(map[int]int32{
+		400: LOG_WARNING,
+		404: LOG_INFO,
+		405: LOG_WARNING,
+		500: LOG_CRIT,
+	})
+	for _, c := range []struct {
+		code            int
+		level, override int32
+	}{
+		{0, LOG_INFO, LOG_INFO},
+		{200, LOG_INFO, LOG_INFO},
+		{302, LOG_INFO, LOG_INFO},
+		{400, LOG_WARNING, LOG_WARNING},
+		{404, LOG_WARNING, LOG_INFO},
+		{405, LOG_WARNING, LOG_WARNING},
+		{499, LOG_WARNING, LOG_WARNING},
+		{500, LOG_ERR, LOG_CRIT},
+		{503, LOG_ERR, LOG_CRIT},
+	} {
+		if got := LevelFromHTTPStatus(c.code); got != c.level {
+			t.Errorf("LevelFromHTTPStatus(%d): expected %d, got %d", c.code, c.level, got)
+		}
+		if got := custom(c.code); got != c.override {
+			t.Errorf("custom mapping of %d: expected %d, got %d", c.code, c.override, got)
+		}
+	}
+	if got := HTTPStatusLevels(nil)(500); got != LOG_INFO {
+		t.Errorf("empty mapping: expected LOG_INFO, got %d", got)
+	}
+}
+
+func TestRecoveryMiddleware(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	handler := RecoveryMiddleware(w)(http.HandlerFunc(func(http.ResponseWriter, *http.Request) {
+		panic("handler broke")
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest("POST", "/orders?id=7", nil))
+
+	if rec.Code != http.StatusInternalServerError {
+		t.Errorf("expected status 500, got %d", rec.Code)
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Level != LOG_EMERG || msg.Short != "panic: handler broke" {
+		t.Errorf("unexpected message: level %d, %s", msg.Level, msg.Short)
+	}
+	if msg.Extra["_http_method"] != "POST" || msg.Extra["_http_url"] != "/orders?id=7" {
+		t.Errorf("request fields missing: %v", msg.Extra)
+	}
+	if stack, _ := msg.Extra["_stack"].(string); !strings.Contains(stack, "TestRecoveryMiddleware") {
+		t.Errorf("stack trace missing: %q", stack)
+	}
+}
@@ -0,0 +1,50 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import "os"
+
+// kubernetesFields maps the environment variables WithKubernetesFields
+// reads to the fields it adds.
+var kubernetesFields = []struct{ env, field string }{
+	{"POD_NAME", "_pod_name"},
+	{"POD_NAMESPACE", "_pod_namespace"},
+	{"NODE_NAME", "_node_name"},
+}
+
+// WithKubernetesFields returns a child writer of w, see With, adding
+// the name and namespace of the Kubernetes pod and the name of its node
+// to every message, as _pod_name, _pod_namespace and _node_name.  They
+// are read from the environment variables POD_NAME, POD_NAMESPACE and
+// NODE_NAME, which the pod spec has to set through the downward API:
+//
+//	env:
+//	- name: POD_NAME
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: metadata.name
+//	- name: POD_NAMESPACE
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: metadata.namespace
+//	- name: NODE_NAME
+//	  valueFrom:
+//	    fieldRef:
+//	      fieldPath: spec.nodeName
+//
+// Variables that aren't set or empty are left out; if none is set, w
+// itself is returned, so outside Kubernetes nothing changes.
+func WithKubernetesFields(w *Writer) *Writer {
+	fields := make(map[string]interface{}, len(kubernetesFields))
+	for _, f := range kubernetesFields {
+		if v := os.Getenv(f.env); v != "" {
+			fields[f.field] = v
+		}
+	}
+	if len(fields) == 0 {
+		return w
+	}
+	return w.With(fields)
+}
@@ -0,0 +1,50 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"testing"
+)
+
+func TestWithKubernetesFields(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	t.Setenv("POD_NAME", "")
+	t.Setenv("POD_NAMESPACE", "")
+	t.Setenv("NODE_NAME", "")
+	if WithKubernetesFields(w) != w {
+		t.Errorf("expected the writer itself outside Kubernetes")
+	}
+
+	t.Setenv("POD_NAME", "api-5d8f-x2x9q")
+	t.Setenv("POD_NAMESPACE", "shop")
+	k8s := WithKubernetesFields(w)
+	if err = k8s.Log(LOG_INFO, "in a pod"); err != nil {
+		t.Errorf("Log: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Extra["_pod_name"] != "api-5d8f-x2x9q" || msg.Extra["_pod_namespace"] != "shop" {
+		t.Errorf("expected the pod fields, got %v", msg.Extra)
+	}
+	if _, ok := msg.Extra["_node_name"]; ok {
+		t.Errorf("expected no _node_name without NODE_NAME, got %v", msg.Extra)
+	}
+}
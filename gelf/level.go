@@ -0,0 +1,65 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+// LevelMapper maps the level of another logging package to a syslog
+// severity level, so that adapters bridging loggers to GELF agree on
+// one mapping and teams can plug in their own, e.g. for a custom
+// "trace" level.
+type LevelMapper func(level int) int32
+
+// SlogLevels maps log/slog levels: below slog.LevelInfo is LOG_DEBUG,
+// below slog.LevelWarn LOG_INFO, below slog.LevelError LOG_WARNING and
+// the rest LOG_ERR.
+func SlogLevels(level int) int32 {
+	switch {
+	case level < 0:
+		return LOG_DEBUG
+	case level < 4:
+		return LOG_INFO
+	case level < 8:
+		return LOG_WARNING
+	}
+	return LOG_ERR
+}
+
+// LogrusLevels maps github.com/sirupsen/logrus levels, from PanicLevel
+// (0), which is LOG_ALERT, to TraceLevel (6), which is LOG_DEBUG like
+// DebugLevel.
+func LogrusLevels(level int) int32 {
+	switch {
+	case level <= 0:
+		return LOG_ALERT
+	case level == 1:
+		return LOG_CRIT
+	case level == 2:
+		return LOG_ERR
+	case level == 3:
+		return LOG_WARNING
+	case level == 4:
+		return LOG_INFO
+	}
+	return LOG_DEBUG
+}
+
+// ZapLevels maps go.uber.org/zap levels, from DebugLevel (-1), which is
+// LOG_DEBUG, to FatalLevel (5), which is LOG_EMERG.
+func ZapLevels(level int) int32 {
+	switch {
+	case level < 0:
+		return LOG_DEBUG
+	case level == 0:
+		return LOG_INFO
+	case level == 1:
+		return LOG_WARNING
+	case level == 2:
+		return LOG_ERR
+	case level == 3:
+		return LOG_CRIT
+	case level == 4:
+		return LOG_ALERT
+	}
+	return LOG_EMERG
+}
@@ -0,0 +1,33 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"testing"
+)
+
+func TestLevelMappers(t *testing.T) {
+	mappings := []struct {
+		name     string
+		mapper   LevelMapper
+		levels   []int
+		expected []int32
+	}{
+		{"slog", SlogLevels, []int{-8, -4, 0, 2, 4, 8, 12},
+			[]int32{LOG_DEBUG, LOG_DEBUG, LOG_INFO, LOG_INFO, LOG_WARNING, LOG_ERR, LOG_ERR}},
+		{"logrus", LogrusLevels, []int{0, 1, 2, 3, 4, 5, 6},
+			[]int32{LOG_ALERT, LOG_CRIT, LOG_ERR, LOG_WARNING, LOG_INFO, LOG_DEBUG, LOG_DEBUG}},
+		{"zap", ZapLevels, []int{-1, 0, 1, 2, 3, 4, 5},
+			[]int32{LOG_DEBUG, LOG_INFO, LOG_WARNING, LOG_ERR, LOG_CRIT, LOG_ALERT, LOG_EMERG}},
+	}
+	for _, m := range mappings {
+		for i, level := range m.levels {
+			if got := m.mapper(level); got != m.expected[i] {
+				t.Errorf("%s level %d: expected %d, got %d", m.name, level, m.expected[i], got)
+			}
+		}
+	}
+
+}
@@ -0,0 +1,102 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package gelf
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// NewMulticastWriter returns a Writer sending to the multicast group
+// addr, such as "239.1.2.3:12201", so that every collector that joined
+// the group receives the messages.  They leave through the network
+// interface named ifname, or one the system picks if ifname is empty,
+// and cross at most ttl routers; a ttl of 0 keeps the system default of
+// 1, which keeps them on the local network.  SetAddr keeps applying
+// both options.
+func NewMulticastWriter(addr, appname string, ttl int, ifname string) (*Writer, error) {
+	var ifi *net.Interface
+	if ifname != "" {
+		var err error
+		if ifi, err = net.InterfaceByName(ifname); err != nil {
+			return nil, fmt.Errorf("InterfaceByName('%s'): %s", ifname, err)
+		}
+	}
+	if ttl < 0 || ttl > 255 {
+		return nil, fmt.Errorf("invalid multicast TTL %d", ttl)
+	}
+
+	dial := func(addr string) (net.Conn, error) {
+		udpAddr, err := net.ResolveUDPAddr("udp", addr)
+		if err != nil {
+			return nil, fmt.Errorf("ResolveUDPAddr('%s'): %s", addr, err)
+		}
+		if !udpAddr.IP.IsMulticast() {
+			return nil, fmt.Errorf("%s is not a multicast address", udpAddr.IP)
+		}
+
+		// the options must be set before connecting, which picks
+		// the route
+		d := net.Dialer{
+			Control: func(network, address string, c syscall.RawConn) error {
+				return setMulticastOptions(c, udpAddr.IP.To4() != nil, ttl, ifi)
+			},
+		}
+		return d.Dial("udp", addr)
+	}
+	return newWriter("udp", addr, appname, dial)
+}
+
+// setMulticastOptions sets the TTL, or hop limit for IPv6, and the
+// outgoing interface of multicast datagrams on a socket.
+func setMulticastOptions(c syscall.RawConn, ipv4 bool, ttl int, ifi *net.Interface) error {
+	var ifAddr [4]byte
+	if ipv4 && ifi != nil {
+		addrs, err := ifi.Addrs()
+		if err != nil {
+			return fmt.Errorf("Addrs: %s", err)
+		}
+		found := false
+		for _, a := range addrs {
+			if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.To4() != nil {
+				copy(ifAddr[:], ipNet.IP.To4())
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("interface %s has no IPv4 address", ifi.Name)
+		}
+	}
+
+	var err error
+	cErr := c.Control(func(fd uintptr) {
+		s := int(fd)
+		switch {
+		case ipv4 && ttl > 0:
+			err = setMulticastTTL(s, ttl)
+		case !ipv4 && ttl > 0:
+			err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_HOPS, ttl)
+		}
+		if err != nil || ifi == nil {
+			return
+		}
+		if ipv4 {
+			err = syscall.SetsockoptInet4Addr(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF, ifAddr)
+		} else {
+			err = syscall.SetsockoptInt(s, syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_IF, ifi.Index)
+		}
+	})
+	if cErr != nil {
+		return cErr
+	}
+	if err != nil {
+		return fmt.Errorf("setsockopt: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,79 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package gelf
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestMulticastWriter(t *testing.T) {
+	ifi := multicastInterface(t)
+
+	r, err := NewMulticastReader("239.255.12.201:0", ifi.Name)
+	if err != nil {
+		t.Skipf("NewMulticastReader: %s", err)
+	}
+	defer r.Close()
+	_, port, _ := net.SplitHostPort(r.Addr())
+
+	w, err := NewMulticastWriter(net.JoinHostPort("239.255.12.201", port), "", 3, ifi.Name)
+	if err != nil {
+		t.Errorf("NewMulticastWriter: %s", err)
+		return
+	}
+	defer w.Close()
+
+	raw, err := w.Conn().(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Errorf("SyscallConn: %s", err)
+		return
+	}
+	var ttl int
+	var ifAddr [4]byte
+	raw.Control(func(fd uintptr) {
+		ttl, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL)
+		ifAddr, _ = syscall.GetsockoptInet4Addr(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_IF)
+	})
+	if ttl != 3 {
+		t.Errorf("expected multicast TTL 3, got %d", ttl)
+	}
+	addrs, _ := ifi.Addrs()
+	found := false
+	for _, a := range addrs {
+		if ipNet, ok := a.(*net.IPNet); ok && ipNet.IP.Equal(net.IP(ifAddr[:])) {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("multicast interface %v isn't one of %s: %v", ifAddr, ifi.Name, addrs)
+	}
+
+	if _, err = w.Write([]byte("to the group")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	msg, err := r.ReadMessageTimeout(time.Second)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Skip("multicast isn't routed here")
+	}
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "to the group" {
+		t.Errorf("msg.Short: expected to the group, got %s", msg.Short)
+	}
+
+	if _, err = NewMulticastWriter("127.0.0.1:12201", "", 0, ""); err == nil {
+		t.Errorf("NewMulticastWriter to a unicast address didn't fail")
+	}
+}
@@ -0,0 +1,15 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build dragonfly || netbsd || openbsd
+
+package gelf
+
+import "syscall"
+
+// setMulticastTTL sets the TTL of the IPv4 multicast datagrams sent on
+// socket s, which these systems take as a u_char, failing on an int.
+func setMulticastTTL(s, ttl int) error {
+	return syscall.SetsockoptByte(s, syscall.IPPROTO_IP, syscall.IP_MULTICAST_TTL, byte(ttl))
+}
@@ -0,0 +1,105 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Proxy forwards the messages received by a Reader to a Writer, for
+// relaying or aggregating GELF traffic.  Messages are passed on in
+// their JSON encoding, without being decoded and encoded again, so
+// they arrive unchanged apart from their compression.  In particular,
+// the original timestamp is kept: the fields of the Writer, such as
+// TimeFunc, IntegerTimestamp or NoDefaultHost, don't apply, as with
+// WriteRaw.
+type Proxy struct {
+	forwarded uint64 // accessed atomically, keep 64-bit aligned
+	dropped   uint64 // accessed atomically, keep 64-bit aligned
+	stopped   int32  // accessed atomically
+
+	mu      sync.Mutex // guards running and the deadline Stop sets
+	running bool
+
+	src *Reader
+	dst *Writer
+}
+
+// NewProxy returns a Proxy forwarding messages from src to dst.
+func NewProxy(src *Reader, dst *Writer) *Proxy {
+	return &Proxy{src: src, dst: dst}
+}
+
+// Run forwards messages until Stop is called or reading from the
+// source fails.  Messages that cannot be decompressed or sent are
+// dropped and counted.  It returns nil after Stop, and may be called
+// again afterwards.
+func (p *Proxy) Run() error {
+	p.mu.Lock()
+	if atomic.SwapInt32(&p.stopped, 0) != 0 {
+		// stopped before it got going
+		p.mu.Unlock()
+		return nil
+	}
+	p.running = true
+	p.mu.Unlock()
+	defer func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		p.running = false
+		if atomic.SwapInt32(&p.stopped, 0) != 0 {
+			// undo the deadline of Stop, so the Reader can be used
+			// again
+			p.src.conn.SetReadDeadline(time.Time{})
+		}
+	}()
+
+	for {
+		cBuf, _, err := p.src.readPayload()
+		if err != nil {
+			if atomic.LoadInt32(&p.stopped) != 0 {
+				return nil
+			}
+			return err
+		}
+
+		data, err := decompress(cBuf)
+		if err == nil {
+			err = p.dst.WriteRaw(data)
+		}
+		if err != nil {
+			atomic.AddUint64(&p.dropped, 1)
+			continue
+		}
+		atomic.AddUint64(&p.forwarded, 1)
+	}
+}
+
+// Stop makes Run return once the message currently being forwarded
+// has been sent.  Neither the Reader nor the Writer is closed; Stop
+// interrupts Run with a read deadline on the Reader, which Run clears
+// before returning, along with any deadline set before.  If Run hasn't
+// started yet, it returns as soon as it does.
+func (p *Proxy) Stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	atomic.StoreInt32(&p.stopped, 1)
+	if p.running {
+		// interrupt the blocked read
+		p.src.conn.SetReadDeadline(time.Now())
+	}
+}
+
+// Forwarded returns the number of messages sent to the Writer.
+func (p *Proxy) Forwarded() uint64 {
+	return atomic.LoadUint64(&p.forwarded)
+}
+
+// Dropped returns the number of messages that could not be forwarded.
+func (p *Proxy) Dropped() uint64 {
+	return atomic.LoadUint64(&p.dropped)
+}
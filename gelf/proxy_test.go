@@ -0,0 +1,199 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"fmt"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestProxy(t *testing.T) {
+	src, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer src.Close()
+	dst, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer dst.Close()
+
+	relay, err := NewWriter(dst.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	relay.CompressionType = CompressZlib
+
+	p := NewProxy(src, relay)
+	done := make(chan error, 1)
+	go func() {
+		done <- p.Run()
+	}()
+
+	w, err := NewWriter(src.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	conn, err := net.Dial("udp", src.Addr())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	for i := 0; i < 3; i++ {
+		m := Message{Version: "1.1", Host: "origin", Short: fmt.Sprintf("msg %d", i), TimeUnix: float64(i + 1)}
+		if err = w.WriteMessage(&m); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+		if i == 1 {
+			// gzip magic followed by garbage
+			conn.Write([]byte{0x1f, 0x8b, 0, 0})
+		}
+	}
+
+	for i := 0; i < 3; i++ {
+		msg, err := dst.ReadMessageTimeout(time.Second)
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Short != fmt.Sprintf("msg %d", i) || msg.Host != "origin" || msg.TimeUnix != float64(i+1) {
+			t.Errorf("message %d changed by the proxy: %+v", i, msg)
+		}
+	}
+
+	p.Stop()
+	select {
+	case err = <-done:
+		if err != nil {
+			t.Errorf("Run: %s", err)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Run didn't return after Stop")
+		return
+	}
+
+	if p.Forwarded() != 3 || p.Dropped() != 1 {
+		t.Errorf("expected 3 forwarded and 1 dropped, got %d and %d", p.Forwarded(), p.Dropped())
+	}
+}
+
+// tests that the Reader works after Stop, and that Run can be started
+// again
+func TestProxyStopKeepsReader(t *testing.T) {
+	src, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer src.Close()
+	dst, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer dst.Close()
+	relay, err := NewWriter(dst.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w, err := NewWriter(src.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	p := NewProxy(src, relay)
+	for round := 0; round < 2; round++ {
+		done := make(chan error, 1)
+		go func() {
+			done <- p.Run()
+		}()
+		if _, err = w.Write([]byte(fmt.Sprintf("relayed %d", round))); err != nil {
+			t.Errorf("w.Write: %s", err)
+			return
+		}
+		msg, err := dst.ReadMessageTimeout(time.Second)
+		if err != nil || msg.Short != fmt.Sprintf("relayed %d", round) {
+			t.Errorf("round %d: ReadMessage: %v, %v", round, msg, err)
+			return
+		}
+		p.Stop()
+		if err = <-done; err != nil {
+			t.Errorf("Run: %s", err)
+			return
+		}
+
+		if _, err = w.Write([]byte("read directly")); err != nil {
+			t.Errorf("w.Write: %s", err)
+			return
+		}
+		msg, err = src.ReadMessage()
+		if err != nil || msg.Short != "read directly" {
+			t.Errorf("round %d: ReadMessage after Stop: %v, %v", round, msg, err)
+			return
+		}
+	}
+}
+
+// tests that relayed messages keep their timestamps, whatever the
+// relaying writer is set to
+func TestProxyPreservesTimestamp(t *testing.T) {
+	src, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer src.Close()
+	dst, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer dst.Close()
+
+	relay, err := NewWriter(dst.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	relay.IntegerTimestamp = true
+	relay.TimeFunc = func() time.Time { return time.Unix(2000000000, 0) }
+
+	p := NewProxy(src, relay)
+	go p.Run()
+	defer p.Stop()
+
+	w, err := NewWriter(src.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	for _, ts := range []float64{1500000000.123456, 0} {
+		m := Message{Version: "1.1", Host: "origin", Short: "hop", TimeUnix: ts}
+		if err = w.WriteMessage(&m); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+		msg, err := dst.ReadMessageTimeout(time.Second)
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.TimeUnix != ts {
+			t.Errorf("expected timestamp %f, got %f", ts, msg.TimeUnix)
+		}
+	}
+}
@@ -10,38 +10,234 @@ import (
 	"compress/zlib"
 	"encoding/json"
 	"fmt"
+	"hash/fnv"
 	"io"
+	"io/ioutil"
 	"net"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 type Reader struct {
-	mu   sync.Mutex
-	conn net.Conn
+	bad          uint64     // accessed atomically, keep 64-bit aligned
+	datagrams    uint64     // accessed atomically, keep 64-bit aligned
+	chunked      uint64     // accessed atomically, keep 64-bit aligned
+	reassembled  uint64     // accessed atomically, keep 64-bit aligned
+	messages     uint64     // accessed atomically, keep 64-bit aligned
+	decodeErrors uint64     // accessed atomically, keep 64-bit aligned
+	duplicates   uint64     // accessed atomically, keep 64-bit aligned
+	mu           sync.Mutex // guards the reassembler's limits and the dedup window
+	conn         *net.UDPConn
+
+	// MaxPendingMessages and MaxPendingBytes bound the memory used
+	// to reassemble chunked messages, and ChunkTimeout how long the
+	// chunks of a message may take to arrive, see Reassembler.  The
+	// constructors set ChunkTimeout to DefaultChunkTimeout and
+	// MaxPendingBytes to DefaultMaxPendingBytes, so that lost chunks
+	// don't hold on to memory forever; zero means no limit.
+	MaxPendingMessages int
+	MaxPendingBytes    int
+	ChunkTimeout       time.Duration
+
+	// Lenient makes ReadMessage accept JSON objects that aren't valid
+	// GELF, such as those of semi-compliant producers, instead of
+	// failing on them.  See ReadMessage for how they are wrapped.
+	Lenient bool
+
+	// DedupWindow, when non-zero, makes the reader suppress messages
+	// that arrive again within that time, as UDP may duplicate them.
+	// Messages are told apart by a hash of their payload, so two
+	// identical messages count as duplicates even if they were sent
+	// twice on purpose; set Writer.AddSequence on the sender to keep
+	// them apart.  Suppressed messages are counted in the Duplicates
+	// of Stats.
+	DedupWindow time.Duration
+
+	// MaxDedupEntries bounds the number of payloads remembered for
+	// DedupWindow; beyond it, the oldest are forgotten early, so that
+	// a flood of messages can't exhaust memory.  Zero means
+	// DefaultMaxDedupEntries.
+	MaxDedupEntries int
+
+	chunks    Reassembler
+	seen      map[uint64]time.Time // payload hashes in the dedup window
+	seenOrder []seenPayload        // oldest first
+	clock     func() time.Time     // time.Now if nil, for tests
 }
 
+// seenPayload is a payload hash in the dedup window of a Reader.
+type seenPayload struct {
+	hash uint64
+	at   time.Time
+}
+
+// Defaults of the limits of a Reader.
+const (
+	// DefaultChunkTimeout is the time the GELF documentation gives
+	// the chunks of a message to arrive in.
+	DefaultChunkTimeout = 5 * time.Second
+	// DefaultMaxPendingBytes holds 32 incomplete messages of the
+	// maximum size, 128 chunks of ChunkSize bytes.
+	DefaultMaxPendingBytes = 32 * maxChunks * ChunkSize
+	// DefaultMaxDedupEntries takes a few MiB at most.
+	DefaultMaxDedupEntries = 1 << 16
+)
+
+// NewReader returns a Reader listening for GELF messages on the UDP
+// address addr, reassembling chunked messages within the default
+// limits.
 func NewReader(addr string) (*Reader, error) {
-	var err error
-	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	return NewReaderWithNetwork("udp", addr)
+}
+
+// NewReaderWithNetwork is like NewReader, but listens on the given
+// network: "udp4" or "udp6" to force IPv4 or IPv6, or "udp" for either.
+func NewReaderWithNetwork(network, addr string) (*Reader, error) {
+	if err := checkUDPNetwork(network); err != nil {
+		return nil, err
+	}
+	udpAddr, err := net.ResolveUDPAddr(network, addr)
 	if err != nil {
 		return nil, fmt.Errorf("ResolveUDPAddr('%s'): %s", addr, err)
 	}
 
-	conn, err := net.ListenUDP("udp", udpAddr)
+	conn, err := net.ListenUDP(network, udpAddr)
 	if err != nil {
 		return nil, fmt.Errorf("ListenUDP: %s", err)
 	}
 
+	return newReader(conn), nil
+}
+
+// NewMulticastReader returns a Reader joining the multicast group addr,
+// such as "239.1.2.3:12201", on the network interface named ifname, or
+// on one the system picks if ifname is empty.  Chunked messages are
+// reassembled as with NewReader.
+//
+// The loopback interface usually doesn't support multicast, so pick a
+// real one.  Messages sent from the same host arrive only if the sender
+// loops multicast back, which is the default.  The Reader also gets
+// unicast datagrams sent to its port.
+func NewMulticastReader(addr, ifname string) (*Reader, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("ResolveUDPAddr('%s'): %s", addr, err)
+	}
+
+	var ifi *net.Interface
+	if ifname != "" {
+		if ifi, err = net.InterfaceByName(ifname); err != nil {
+			return nil, fmt.Errorf("InterfaceByName('%s'): %s", ifname, err)
+		}
+	}
+
+	conn, err := net.ListenMulticastUDP("udp", ifi, udpAddr)
+	if err != nil {
+		return nil, fmt.Errorf("ListenMulticastUDP: %s", err)
+	}
+
+	return newReader(conn), nil
+}
+
+// newReader returns a Reader reading from conn with the default limits.
+func newReader(conn *net.UDPConn) *Reader {
 	r := new(Reader)
 	r.conn = conn
+	r.ChunkTimeout = DefaultChunkTimeout
+	r.MaxPendingBytes = DefaultMaxPendingBytes
+	return r
+}
+
+// NewReaderWithReadBuffer is like NewReader, but also sets the size of
+// the kernel receive buffer of the socket, see SetReadBuffer.
+func NewReaderWithReadBuffer(addr string, bytes int) (*Reader, error) {
+	r, err := NewReader(addr)
+	if err != nil {
+		return nil, err
+	}
+	if err = r.SetReadBuffer(bytes); err != nil {
+		r.Close()
+		return nil, err
+	}
 	return r, nil
 }
 
+// SetReadBuffer sets the size of the kernel receive buffer of the
+// socket (SO_RCVBUF).  A busy collector needs a large buffer to not
+// drop datagrams that arrive faster than they are read.  The OS may
+// cap the size silently, e.g. to net.core.rmem_max on Linux.
+func (r *Reader) SetReadBuffer(bytes int) error {
+	if err := r.conn.SetReadBuffer(bytes); err != nil {
+		return fmt.Errorf("SetReadBuffer: %s", err)
+	}
+	return nil
+}
+
 func (r *Reader) Addr() string {
 	return r.conn.LocalAddr().String()
 }
 
+// Close closes the connection, interrupting a blocked read.
+func (r *Reader) Close() error {
+	return r.conn.Close()
+}
+
+// Dropped returns the number of incomplete chunked messages discarded
+// because the reassembly limits were exceeded or they timed out.
+func (r *Reader) Dropped() uint64 {
+	return r.chunks.Dropped()
+}
+
+// BadDatagrams returns the number of datagrams discarded because they
+// were too short or malformed chunks.
+func (r *Reader) BadDatagrams() uint64 {
+	return atomic.LoadUint64(&r.bad)
+}
+
+// ReaderStats are the counters of a Reader, see Reader.Stats.
+type ReaderStats struct {
+	Datagrams    uint64 // datagrams received
+	Chunks       uint64 // datagrams that were chunks of a message
+	Reassembled  uint64 // messages put together from chunks
+	Messages     uint64 // complete messages received, chunked or not
+	Dropped      uint64 // incomplete chunked messages discarded, see Dropped
+	BadDatagrams uint64 // see BadDatagrams
+	DecodeErrors uint64 // messages that failed to decompress or decode
+	Duplicates   uint64 // messages suppressed by the DedupWindow
+}
+
+// Stats returns the counters of the reader, each read atomically, for
+// monitoring a collector.  Messages counts every message read, by
+// ReadMessage or ReadRaw, including those that then fail to decode.
+func (r *Reader) Stats() ReaderStats {
+	return ReaderStats{
+		Datagrams:    atomic.LoadUint64(&r.datagrams),
+		Chunks:       atomic.LoadUint64(&r.chunked),
+		Reassembled:  atomic.LoadUint64(&r.reassembled),
+		Messages:     atomic.LoadUint64(&r.messages),
+		Dropped:      r.chunks.Dropped(),
+		BadDatagrams: atomic.LoadUint64(&r.bad),
+		DecodeErrors: atomic.LoadUint64(&r.decodeErrors),
+		Duplicates:   atomic.LoadUint64(&r.duplicates),
+	}
+}
+
+// PendingMessage describes a chunked message that is being reassembled.
+type PendingMessage struct {
+	ID       []byte // the 8 byte message id
+	Received int    // number of chunks received so far
+	Total    int    // number of chunks the message consists of
+}
+
+// PendingChunks returns the chunked messages that are incomplete, oldest
+// first.  Together with Dropped, it helps to diagnose lossy networks.
+// The result is a copy that is safe to keep.
+func (r *Reader) PendingChunks() []PendingMessage {
+	return r.chunks.Pending()
+}
+
 // FIXME: this will discard data if p isn't big enough to hold the
 // full message.
 func (r *Reader) Read(p []byte) (int, error) {
@@ -61,80 +257,253 @@ func (r *Reader) Read(p []byte) (int, error) {
 	return strings.NewReader(data).Read(p)
 }
 
+// ReadMessage reads and decodes the next message.
+//
+// In Lenient mode, a JSON object that doesn't decode as GELF or lacks
+// one of the required version, host and short_message fields is
+// wrapped instead: the returned message has the whole object in the
+// "_raw" field, the host of the sender unless the object names one,
+// and a short message taken from the short_message, message or msg
+// field of the object, or the object itself.
 func (r *Reader) ReadMessage() (*Message, error) {
-	cBuf := make([]byte, ChunkSize)
-	var (
-		err        error
-		n, length  int
-		cid, ocid  []byte
-		seq, total uint8
-		cHead      []byte
-		cReader    io.Reader
-		chunks     [][]byte
-	)
+	msg := new(Message)
+	if err := r.ReadMessageInto(msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
 
-	for got := 0; got < 128 && (total == 0 || got < int(total)); got++ {
-		if n, err = r.conn.Read(cBuf); err != nil {
-			return nil, fmt.Errorf("Read: %s", err)
+// ReadMessageInto is like ReadMessage, but decodes the next message into
+// m, so that busy collectors can recycle messages instead of allocating
+// one per datagram.  All fields of m are overwritten; its Extra map is
+// cleared and reused.  The contents of m are thus only valid until the
+// next read into it, though values taken out of Extra stay valid.
+func (r *Reader) ReadMessageInto(m *Message) error {
+	data, addr, err := r.ReadRaw()
+	if err != nil {
+		return err
+	}
+
+	extra := m.Extra
+	for k := range extra {
+		delete(extra, k)
+	}
+	*m = Message{Extra: extra}
+	if err = m.UnmarshalJSON(data); err != nil {
+		err = fmt.Errorf("json.Unmarshal: %s", err)
+	}
+	if r.Lenient && (err != nil || m.Version == "" || m.Host == "" || m.Short == "") {
+		wrapped, err := wrapMessage(data, addr)
+		if err != nil {
+			atomic.AddUint64(&r.decodeErrors, 1)
+			return err
 		}
-		cHead, cBuf = cBuf[:2], cBuf[:n]
-
-		if bytes.Equal(cHead, magicChunked) {
-			//fmt.Printf("chunked %v\n", cBuf[:14])
-			cid, seq, total = cBuf[2:2+8], cBuf[2+8], cBuf[2+8+1]
-			if ocid != nil && !bytes.Equal(cid, ocid) {
-				return nil, fmt.Errorf("out-of-band message %v (awaited %v)", cid, ocid)
-			} else if ocid == nil {
-				ocid = cid
-				chunks = make([][]byte, total)
+		if extra != nil {
+			for k := range extra {
+				delete(extra, k)
 			}
-			n = len(cBuf) - chunkedHeaderLen
-			//fmt.Printf("setting chunks[%d]: %d\n", seq, n)
-			chunks[seq] = append(make([]byte, 0, n), cBuf[chunkedHeaderLen:]...)
-			length += n
-		} else { //not chunked
-			if total > 0 {
-				return nil, fmt.Errorf("out-of-band message (not chunked)")
+			for k, v := range wrapped.Extra {
+				extra[k] = v
 			}
-			break
+			wrapped.Extra = extra
 		}
+		*m = *wrapped
+		return nil
+	}
+	if err != nil {
+		atomic.AddUint64(&r.decodeErrors, 1)
 	}
-	//fmt.Printf("\nchunks: %v\n", chunks)
+	return err
+}
 
-	if length > 0 {
-		if cap(cBuf) < length {
-			cBuf = append(cBuf, make([]byte, 0, length-cap(cBuf))...)
-		}
-		cBuf = cBuf[:0]
-		for i := range chunks {
-			//fmt.Printf("appending %d %v\n", i, chunks[i])
-			cBuf = append(cBuf, chunks[i]...)
+// wrapMessage wraps a JSON object that isn't valid GELF into a message,
+// see ReadMessage.
+func wrapMessage(data []byte, addr net.Addr) (*Message, error) {
+	var obj map[string]interface{}
+	if err := json.Unmarshal(data, &obj); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %s", err)
+	}
+
+	msg := &Message{
+		Version: "1.1",
+		Short:   string(data),
+		Extra:   map[string]interface{}{"_raw": string(data)},
+	}
+	for _, k := range []string{"short_message", "message", "msg"} {
+		if s, ok := obj[k].(string); ok && s != "" {
+			msg.Short = s
+			break
 		}
-		cHead = cBuf[:2]
 	}
+	if host, ok := obj["host"].(string); ok && host != "" {
+		msg.Host = host
+	} else if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		msg.Host = udpAddr.IP.String()
+	}
+	if ts, ok := obj["timestamp"].(float64); ok {
+		msg.TimeUnix = ts
+	}
+	return msg, nil
+}
 
-	// the data we get from the wire is compressed
-	if bytes.Equal(cHead, magicGzip) {
-		cReader, err = gzip.NewReader(bytes.NewReader(cBuf))
-	} else if cHead[0] == magicZlib[0] &&
-		(int(cHead[0])*256+int(cHead[1]))%31 == 0 {
+// decodeMessage decodes the JSON encoding of a message.
+func decodeMessage(data []byte) (*Message, error) {
+	msg := new(Message)
+	if err := json.NewDecoder(bytes.NewReader(data)).Decode(&msg); err != nil {
+		return nil, fmt.Errorf("json.Unmarshal: %s", err)
+	}
+
+	return msg, nil
+}
+
+// ReadMessageTimeout is like ReadMessage, but gives up when no complete
+// message arrived within d.  The error then satisfies
+// errors.Is(err, os.ErrDeadlineExceeded).  Chunks of incomplete
+// messages received so far are kept for the next read.
+func (r *Reader) ReadMessageTimeout(d time.Duration) (*Message, error) {
+	if err := r.conn.SetReadDeadline(time.Now().Add(d)); err != nil {
+		return nil, fmt.Errorf("SetReadDeadline: %s", err)
+	}
+	defer r.conn.SetReadDeadline(time.Time{})
+
+	return r.ReadMessage()
+}
+
+// ReadRaw returns the JSON encoding of the next message, reassembled
+// and decompressed but not decoded, along with the address of the
+// peer that sent it.  This is useful to forward messages without
+// the cost of decoding and re-encoding them.
+func (r *Reader) ReadRaw() ([]byte, net.Addr, error) {
+	cBuf, addr, err := r.readPayload()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	data, err := decompress(cBuf)
+	if err != nil {
+		atomic.AddUint64(&r.decodeErrors, 1)
+		return nil, nil, err
+	}
+	return data, addr, nil
+}
+
+// isCompressed reports whether a payload starts with the magic bytes
+// of gzip or zlib.
+func isCompressed(cBuf []byte) bool {
+	if len(cBuf) < 2 {
+		return false
+	}
+	cHead := cBuf[:2]
+	return bytes.Equal(cHead, magicGzip) ||
 		// zlib is slightly more complicated, but correct
-		cReader, err = zlib.NewReader(bytes.NewReader(cBuf))
-	} else {
+		cHead[0] == magicZlib[0] && (int(cHead[0])*256+int(cHead[1]))%31 == 0
+}
+
+// decompress detects the compression used for a payload from its
+// magic bytes and returns the uncompressed data.
+func decompress(cBuf []byte) ([]byte, error) {
+	if !isCompressed(cBuf) {
 		// compliance with https://github.com/Graylog2/graylog2-server
 		// treating all messages as uncompressed if  they are not gzip, zlib or
 		// chunked
-		cReader = bytes.NewReader(cBuf)
+		return cBuf, nil
 	}
 
+	var (
+		err     error
+		cReader io.Reader
+	)
+	// the data we get from the wire is compressed
+	if bytes.Equal(cBuf[:2], magicGzip) {
+		cReader, err = gzip.NewReader(bytes.NewReader(cBuf))
+	} else {
+		cReader, err = zlib.NewReader(bytes.NewReader(cBuf))
+	}
 	if err != nil {
-		return nil, fmt.Errorf("NewReader: %s", err)
+		return nil, fmt.Errorf("NewReader: %w", err)
 	}
 
-	msg := new(Message)
-	if err := json.NewDecoder(cReader).Decode(&msg); err != nil {
-		return nil, fmt.Errorf("json.Unmarshal: %s", err)
+	data, err := ioutil.ReadAll(cReader)
+	if err != nil {
+		return nil, fmt.Errorf("decompress: %w", err)
 	}
+	return data, nil
+}
 
-	return msg, nil
+// readPayload reads datagrams until a complete message is available
+// and returns its (possibly compressed) payload.  Chunks of several
+// messages may arrive interleaved; incomplete ones are kept until
+// their remaining chunks arrive, the pending limits evict them or
+// they time out.
+func (r *Reader) readPayload() ([]byte, net.Addr, error) {
+	cBuf := make([]byte, ChunkSize)
+	for {
+		n, addr, err := r.conn.ReadFrom(cBuf)
+		if err != nil {
+			return nil, nil, fmt.Errorf("Read: %w", err)
+		}
+		atomic.AddUint64(&r.datagrams, 1)
+		if n < 2 {
+			atomic.AddUint64(&r.bad, 1)
+			continue
+		}
+		datagram := cBuf[:n]
+		isChunk := bytes.HasPrefix(datagram, magicChunked)
+		if isChunk {
+			atomic.AddUint64(&r.chunked, 1)
+		}
+
+		r.mu.Lock()
+		r.chunks.MaxPendingMessages = r.MaxPendingMessages
+		r.chunks.MaxPendingBytes = r.MaxPendingBytes
+		r.chunks.Timeout = r.ChunkTimeout
+		payload, done, err := r.chunks.Add(datagram)
+		duplicate := err == nil && done && r.duplicate(payload)
+		r.mu.Unlock()
+		if err != nil {
+			atomic.AddUint64(&r.bad, 1)
+		} else if duplicate {
+			atomic.AddUint64(&r.duplicates, 1)
+		} else if done {
+			if isChunk {
+				atomic.AddUint64(&r.reassembled, 1)
+			}
+			atomic.AddUint64(&r.messages, 1)
+			return payload, addr, nil
+		}
+	}
+}
+
+// duplicate reports whether payload was seen within the DedupWindow,
+// and records it otherwise.  r.mu must be held.
+func (r *Reader) duplicate(payload []byte) bool {
+	if r.DedupWindow <= 0 {
+		return false
+	}
+	now := time.Now()
+	if r.clock != nil {
+		now = r.clock()
+	}
+	max := r.MaxDedupEntries
+	if max <= 0 {
+		max = DefaultMaxDedupEntries
+	}
+	for len(r.seenOrder) > 0 &&
+		(now.Sub(r.seenOrder[0].at) >= r.DedupWindow || len(r.seenOrder) >= max) {
+		delete(r.seen, r.seenOrder[0].hash)
+		r.seenOrder = r.seenOrder[1:]
+	}
+
+	h := fnv.New64a()
+	h.Write(payload)
+	hash := h.Sum64()
+	if _, ok := r.seen[hash]; ok {
+		return true
+	}
+	if r.seen == nil {
+		r.seen = make(map[uint64]time.Time)
+	}
+	r.seen[hash] = now
+	r.seenOrder = append(r.seenOrder, seenPayload{hash: hash, at: now})
+	return false
 }
@@ -0,0 +1,604 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chunkDatagram builds a raw GELF chunk datagram.
+func chunkDatagram(id uint64, seq, total uint8, data []byte) []byte {
+	var buf bytes.Buffer
+	buf.Write(magicChunked)
+	binary.Write(&buf, binary.BigEndian, id)
+	buf.WriteByte(seq)
+	buf.WriteByte(total)
+	buf.Write(data)
+	return buf.Bytes()
+}
+
+// tests that a flood of incomplete chunked messages stays within the
+// configured pending limits
+func TestReaderPendingLimits(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	r.MaxPendingMessages = 4
+	r.MaxPendingBytes = 3 * 100
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	filler := bytes.Repeat([]byte{'x'}, 100)
+	for i := uint64(0); i < 100; i++ {
+		if _, err = conn.Write(chunkDatagram(i, 0, 2, filler)); err != nil {
+			t.Errorf("Write: %s", err)
+			return
+		}
+	}
+
+	conn.Write(chunkDatagram(1000, 0, 2, []byte(`{"version":"1.1","host":"h","short_message":"`)))
+	conn.Write(chunkDatagram(1000, 1, 2, []byte(`hi"}`)))
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "hi" {
+		t.Errorf("msg.Short: expected hi, got %s", msg.Short)
+		return
+	}
+
+	if len(r.chunks.pending) > r.MaxPendingMessages {
+		t.Errorf("%d pending messages, limit %d", len(r.chunks.pending), r.MaxPendingMessages)
+	}
+	if r.chunks.pendingBytes > r.MaxPendingBytes {
+		t.Errorf("%d pending bytes, limit %d", r.chunks.pendingBytes, r.MaxPendingBytes)
+	}
+	if r.Dropped() < 96 {
+		t.Errorf("expected at least 96 dropped messages, got %d", r.Dropped())
+	}
+}
+
+// tests that a Reader as NewReader returns it bounds the memory held by
+// incomplete messages
+func TestReaderDefaultLimits(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+	if r.ChunkTimeout != DefaultChunkTimeout || r.MaxPendingBytes != DefaultMaxPendingBytes {
+		t.Errorf("unexpected defaults: timeout %s, %d pending bytes", r.ChunkTimeout, r.MaxPendingBytes)
+	}
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	// lose the second chunk of enough messages to exceed the limit,
+	// in rounds that fit into the socket buffer
+	filler := bytes.Repeat([]byte{'x'}, ChunkSize-chunkedHeaderLen)
+	id := uint64(0)
+	for sent := 0; sent < 2*DefaultMaxPendingBytes; {
+		for i := 0; i < 40; i, id, sent = i+1, id+1, sent+len(filler) {
+			if _, err = conn.Write(chunkDatagram(id, 0, 2, filler)); err != nil {
+				t.Errorf("Write: %s", err)
+				return
+			}
+		}
+		conn.Write(chunkDatagram(1<<32+id, 0, 2, []byte(`{"version":"1.1","host":"h","short_message":"`)))
+		conn.Write(chunkDatagram(1<<32+id, 1, 2, []byte(`hi"}`)))
+		if _, err = r.ReadMessage(); err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+	}
+
+	if r.chunks.pendingBytes > DefaultMaxPendingBytes {
+		t.Errorf("%d pending bytes, default limit %d", r.chunks.pendingBytes, DefaultMaxPendingBytes)
+	}
+	if r.Dropped() == 0 {
+		t.Errorf("expected incomplete messages to be dropped")
+	}
+}
+
+// tests that chunks of different messages may arrive interleaved
+func TestReaderInterleavedChunks(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.Write(chunkDatagram(1, 0, 2, []byte(`{"version":"1.1","host":"h","short_message":"`)))
+	conn.Write(chunkDatagram(2, 1, 2, []byte(`two"}`)))
+	conn.Write(chunkDatagram(2, 0, 2, []byte(`{"version":"1.1","host":"h","short_message":"`)))
+	conn.Write(chunkDatagram(1, 1, 2, []byte(`one"}`)))
+
+	for _, expected := range []string{"two", "one"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+			return
+		}
+	}
+	if r.Dropped() != 0 {
+		t.Errorf("expected no dropped messages, got %d", r.Dropped())
+	}
+}
+
+// tests that ReadRaw returns the decompressed JSON of a message
+func TestReadRaw(t *testing.T) {
+	for _, i := range []CompressType{CompressGzip, CompressZlib, CompressNone} {
+		r, err := NewReader("127.0.0.1:0")
+		if err != nil {
+			t.Errorf("NewReader: %s", err)
+			return
+		}
+
+		w, err := NewWriter(r.Addr(), "")
+		if err != nil {
+			t.Errorf("NewWriter: %s", err)
+			return
+		}
+		w.CompressionType = i
+
+		if _, err = w.Write([]byte("raw message")); err != nil {
+			t.Errorf("w.Write: %s", err)
+			return
+		}
+
+		data, addr, err := r.ReadRaw()
+		if err != nil {
+			t.Errorf("ReadRaw: %s", err)
+			return
+		}
+		if addr == nil || addr.String() != w.conn.LocalAddr().String() {
+			t.Errorf("addr: expected %s, got %v", w.conn.LocalAddr(), addr)
+			return
+		}
+
+		var fields map[string]interface{}
+		if err = json.Unmarshal(data, &fields); err != nil {
+			t.Errorf("json.Unmarshal(%q): %s", data, err)
+			return
+		}
+		if fields["short_message"] != "raw message" {
+			t.Errorf("short_message: expected raw message, got %v", fields["short_message"])
+			return
+		}
+	}
+}
+
+func TestPendingChunks(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.Write(chunkDatagram(1, 0, 3, []byte("a")))
+	conn.Write(chunkDatagram(2, 1, 2, []byte("b")))
+	conn.Write(chunkDatagram(1, 2, 3, []byte("c")))
+	conn.Write([]byte(`{"version":"1.1","host":"h","short_message":"done"}`))
+
+	if _, err = r.ReadMessage(); err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+
+	pending := r.PendingChunks()
+	if len(pending) != 2 {
+		t.Errorf("expected 2 pending messages, got %v", pending)
+		return
+	}
+	id := chunkDatagram(1, 0, 0, nil)[2:10]
+	if !bytes.Equal(pending[0].ID, id) || pending[0].Received != 2 || pending[0].Total != 3 {
+		t.Errorf("pending[0]: expected 2/3 chunks of %v, got %+v", id, pending[0])
+	}
+	if pending[1].Received != 1 || pending[1].Total != 2 {
+		t.Errorf("pending[1]: expected 1/2 chunks, got %+v", pending[1])
+	}
+
+	// the snapshot must not share memory with the reader
+	pending[0].ID[0] = 0xff
+	if r.PendingChunks()[0].ID[0] == 0xff {
+		t.Errorf("PendingChunks returned the reader's id")
+	}
+}
+
+func TestReaderWithReadBuffer(t *testing.T) {
+	r, err := NewReaderWithReadBuffer("127.0.0.1:0", 1<<20)
+	if err != nil {
+		t.Errorf("NewReaderWithReadBuffer: %s", err)
+		return
+	}
+	defer r.Close()
+
+	if err = r.SetReadBuffer(64 << 10); err != nil {
+		t.Errorf("SetReadBuffer: %s", err)
+	}
+
+	r.Close()
+	if err = r.SetReadBuffer(64 << 10); err == nil {
+		t.Errorf("SetReadBuffer on a closed reader didn't fail")
+	}
+}
+
+func TestReadMessageTimeout(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.Write(chunkDatagram(1, 0, 2, []byte(`{"version":"1.1","host":"h","short_message":"`)))
+	if _, err = r.ReadMessageTimeout(50 * time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected a timeout, got %v", err)
+		return
+	}
+
+	// the first chunk must survive the timeout
+	conn.Write(chunkDatagram(1, 1, 2, []byte(`late"}`)))
+	msg, err := r.ReadMessageTimeout(time.Second)
+	if err != nil {
+		t.Errorf("ReadMessageTimeout: %s", err)
+		return
+	}
+	if msg.Short != "late" {
+		t.Errorf("msg.Short: expected late, got %s", msg.Short)
+	}
+}
+
+// tests that a Lenient reader wraps JSON that isn't valid GELF
+func TestReaderLenient(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	raw := `{"msg":"user logged in","user":"alice","host":5}`
+	conn.Write([]byte(raw))
+	if _, err = r.ReadMessage(); err == nil {
+		t.Errorf("ReadMessage of invalid GELF didn't fail")
+		return
+	}
+
+	r.Lenient = true
+	conn.Write([]byte(raw))
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Version != "1.1" || msg.Host != "127.0.0.1" || msg.Short != "user logged in" || msg.Extra["_raw"] != raw {
+		t.Errorf("unexpected wrapped message: %+v", msg)
+	}
+
+	valid := `{"version":"1.1","host":"h","short_message":"valid","_user":"bob"}`
+	conn.Write([]byte(valid))
+	if msg, err = r.ReadMessage(); err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "valid" || msg.Extra["_raw"] != nil {
+		t.Errorf("valid message got wrapped: %+v", msg)
+	}
+}
+
+// multicastInterface returns an interface to test multicast on.
+func multicastInterface(t *testing.T) *net.Interface {
+	ifis, err := net.Interfaces()
+	if err != nil {
+		t.Skipf("Interfaces: %s", err)
+	}
+	for i := range ifis {
+		flags := ifis[i].Flags
+		if flags&net.FlagUp != 0 && flags&net.FlagMulticast != 0 && flags&net.FlagLoopback == 0 {
+			return &ifis[i]
+		}
+	}
+	t.Skip("no multicast interface")
+	return nil
+}
+
+func TestMulticastReader(t *testing.T) {
+	ifi := multicastInterface(t)
+
+	r, err := NewMulticastReader("239.255.12.201:0", ifi.Name)
+	if err != nil {
+		t.Skipf("NewMulticastReader: %s", err)
+	}
+	defer r.Close()
+	_, port, _ := net.SplitHostPort(r.Addr())
+
+	conn, err := net.Dial("udp", net.JoinHostPort("239.255.12.201", port))
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+	conn.Write([]byte(`{"version":"1.1","host":"h","short_message":"multicast"}`))
+
+	msg, err := r.ReadMessageTimeout(time.Second)
+	if errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Skip("multicast isn't routed here")
+	}
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "multicast" {
+		t.Errorf("msg.Short: expected multicast, got %s", msg.Short)
+	}
+}
+
+// tests that ReadMessageInto reuses the message and its Extra map
+func TestReadMessageInto(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	conn.Write([]byte(`{"version":"1.1","host":"h","short_message":"one","full_message":"first","_a":1}`))
+	conn.Write([]byte(`{"version":"1.1","host":"h","short_message":"two","_b":2}`))
+
+	m := new(Message)
+	if err = r.ReadMessageInto(m); err != nil {
+		t.Errorf("ReadMessageInto: %s", err)
+		return
+	}
+	extra := reflect.ValueOf(m.Extra).Pointer()
+	if m.Short != "one" || m.Extra["_a"] != float64(1) {
+		t.Errorf("unexpected first message: %+v", m)
+		return
+	}
+
+	if err = r.ReadMessageInto(m); err != nil {
+		t.Errorf("ReadMessageInto: %s", err)
+		return
+	}
+	if m.Short != "two" || m.Full != "" || len(m.Extra) != 1 || m.Extra["_b"] != float64(2) {
+		t.Errorf("unexpected second message: %+v", m)
+	}
+	if reflect.ValueOf(m.Extra).Pointer() != extra {
+		t.Errorf("Extra map wasn't reused")
+	}
+}
+
+// tests forcing IPv4 or IPv6 on loopback
+func TestNetworks(t *testing.T) {
+	families := []struct {
+		network, addr string
+	}{
+		{"udp4", "127.0.0.1:0"},
+		{"udp6", "[::1]:0"},
+	}
+	for _, f := range families {
+		r, err := NewReaderWithNetwork(f.network, f.addr)
+		if err != nil && f.network == "udp6" {
+			t.Logf("skipping IPv6: %s", err)
+			continue
+		}
+		if err != nil {
+			t.Errorf("NewReaderWithNetwork(%s): %s", f.network, err)
+			return
+		}
+		defer r.Close()
+
+		w, err := NewWriterWithNetwork(f.network, r.Addr(), "")
+		if err != nil {
+			t.Errorf("NewWriterWithNetwork(%s): %s", f.network, err)
+			return
+		}
+		defer w.Close()
+		if _, err = w.Write([]byte("over " + f.network)); err != nil {
+			t.Errorf("w.Write: %s", err)
+			return
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Short != "over "+f.network {
+			t.Errorf("msg.Short: expected over %s, got %s", f.network, msg.Short)
+		}
+	}
+
+	if _, err := NewWriterWithNetwork("udp4", "[::1]:12201", ""); err == nil {
+		t.Errorf("NewWriterWithNetwork(udp4) to an IPv6 address didn't fail")
+	}
+	if _, err := NewReaderWithNetwork("tcp", "127.0.0.1:0"); err == nil {
+		t.Errorf("NewReaderWithNetwork(tcp) didn't fail")
+	}
+}
+
+// tests that the reader's counters follow a loopback session
+func TestReaderStats(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.CompressionType = CompressNone
+	w.ChunkSize = 300
+
+	// a plain message in one datagram, one in 3 chunks, a short
+	// datagram and one that isn't JSON
+	for _, full := range []string{"", strings.Repeat("chunked ", 90)} {
+		m := Message{Version: "1.1", Host: "h", Short: "counted", Full: full}
+		if err = w.WriteMessage(&m); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+	}
+	for _, d := range []string{"x", "not json"} {
+		if _, err = w.Conn().Write([]byte(d)); err != nil {
+			t.Errorf("Write: %s", err)
+			return
+		}
+	}
+
+	for i := 0; i < 2; i++ {
+		if _, err = r.ReadMessage(); err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+	}
+	if _, err = r.ReadMessage(); err == nil {
+		t.Errorf("ReadMessage of a datagram that isn't JSON didn't fail")
+		return
+	}
+
+	expected := ReaderStats{
+		Datagrams:    6,
+		Chunks:       3,
+		Reassembled:  1,
+		Messages:     3,
+		BadDatagrams: 1,
+		DecodeErrors: 1,
+	}
+	if stats := r.Stats(); stats != expected {
+		t.Errorf("expected %+v, got %+v", expected, stats)
+	}
+}
+
+// tests that DedupWindow suppresses duplicated datagrams
+func TestDedupWindow(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+	r.DedupWindow = time.Minute
+	now := time.Unix(1500000000, 0)
+	r.clock = func() time.Time { return now }
+
+	conn, err := net.Dial("udp", r.Addr())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+	send := func(short string) {
+		conn.Write([]byte(`{"version":"1.1","host":"h","short_message":"` + short + `"}`))
+	}
+
+	send("once")
+	send("once")
+	send("other")
+	for _, expected := range []string{"once", "other"} {
+		msg, err := r.ReadMessageTimeout(time.Second)
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Short != expected {
+			t.Errorf("expected %s, got %s", expected, msg.Short)
+		}
+	}
+	if d := r.Stats().Duplicates; d != 1 {
+		t.Errorf("expected 1 duplicate, got %d", d)
+	}
+
+	now = now.Add(r.DedupWindow)
+	send("once")
+	msg, err := r.ReadMessageTimeout(time.Second)
+	if err != nil {
+		t.Errorf("ReadMessage after the window: %s", err)
+		return
+	}
+	if msg.Short != "once" {
+		t.Errorf("expected once, got %s", msg.Short)
+	}
+
+	// beyond MaxDedupEntries, the oldest payloads are forgotten early
+	r.MaxDedupEntries = 3
+	for _, short := range []string{"a", "b", "c", "d", "a"} {
+		send(short)
+		if msg, err = r.ReadMessageTimeout(time.Second); err != nil || msg.Short != short {
+			t.Errorf("expected %s, got %v, %v", short, msg, err)
+			return
+		}
+	}
+	if len(r.seen) > 3 || len(r.seenOrder) > 3 {
+		t.Errorf("expected at most 3 remembered payloads, got %d and %d", len(r.seen), len(r.seenOrder))
+	}
+}
@@ -0,0 +1,193 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+// Reassembler puts chunked GELF messages back together from their
+// chunk datagrams, whatever transport they arrive on.  It is what a
+// Reader uses on its UDP socket.  The zero value is ready to use, and
+// a Reassembler is safe for concurrent use, but its limits must not be
+// changed while Add may be called.
+type Reassembler struct {
+	dropped uint64 // accessed atomically, keep 64-bit aligned
+
+	// MaxPendingMessages and MaxPendingBytes bound the memory used
+	// by incomplete messages.  MaxPendingBytes counts the chunks
+	// received as well as the bookkeeping of each message, which
+	// grows with the number of chunks it declares, so that a flood of
+	// tiny chunks is bounded too.  When either limit would be
+	// exceeded, the oldest incomplete messages are discarded and
+	// counted in Dropped.  Zero means no limit.
+	MaxPendingMessages int
+	MaxPendingBytes    int
+
+	// Timeout, when non-zero, is how long the chunks of a message may
+	// take to arrive, counted from the first one.  Incomplete
+	// messages older than that are discarded on the next Add and
+	// counted in Dropped.  The GELF documentation suggests 5 seconds.
+	Timeout time.Duration
+
+	mu           sync.Mutex
+	pending      map[string]*chunkSet
+	pendingOrder list.List // of *chunkSet, oldest first
+	pendingBytes int
+}
+
+// chunkSet collects the chunks of one chunked message.
+type chunkSet struct {
+	id      string
+	chunks  [][]byte
+	got     int
+	size    int // bytes of the chunks
+	mem     int // bytes counted in pendingBytes
+	started time.Time
+	elem    *list.Element // in pendingOrder
+}
+
+// chunkSetOverhead approximates the memory a pending message takes
+// besides its chunks and their slice headers: the chunkSet, its
+// element of pendingOrder, its 8-byte id and, roughly, its entry in
+// pending.
+const chunkSetOverhead = int(unsafe.Sizeof(chunkSet{})+unsafe.Sizeof(list.Element{})) + 8 + 64
+
+// chunkHeaderSize is the size of an element of chunkSet.chunks.
+const chunkHeaderSize = int(unsafe.Sizeof([]byte(nil)))
+
+// Add feeds a datagram to the reassembler.  Once the last chunk of a
+// message has been added, it returns the complete (possibly
+// compressed) payload and done is true.  A datagram that isn't chunked
+// is returned as is.  Malformed chunks and chunks that don't fit the
+// chunks received before are reported as errors, duplicate chunks are
+// ignored.
+func (a *Reassembler) Add(datagram []byte) (complete []byte, done bool, err error) {
+	if !bytes.HasPrefix(datagram, magicChunked) {
+		return datagram, true, nil
+	}
+	if len(datagram) < chunkedHeaderLen {
+		return nil, false, fmt.Errorf("short chunk of %d bytes", len(datagram))
+	}
+	cid, seq, total := datagram[2:2+8], datagram[2+8], datagram[2+8+1]
+	if total == 0 || total > maxChunks || seq >= total {
+		return nil, false, fmt.Errorf("invalid chunk %d/%d", seq, total)
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	now := time.Now()
+	a.expire(now)
+
+	if a.pending == nil {
+		a.pending = make(map[string]*chunkSet)
+	}
+	id := string(cid)
+	set, ok := a.pending[id]
+	if !ok {
+		set = &chunkSet{id: id, chunks: make([][]byte, total), started: now}
+		set.mem = chunkSetOverhead + int(total)*chunkHeaderSize
+		set.elem = a.pendingOrder.PushBack(set)
+		a.pending[id] = set
+		a.pendingBytes += set.mem
+	}
+	if int(total) != len(set.chunks) {
+		return nil, false, fmt.Errorf("chunk %d/%d of a message of %d chunks", seq, total, len(set.chunks))
+	}
+	if set.chunks[seq] != nil {
+		return nil, false, nil
+	}
+
+	n := len(datagram) - chunkedHeaderLen
+	set.chunks[seq] = append(make([]byte, 0, n), datagram[chunkedHeaderLen:]...)
+	set.got++
+	set.size += n
+	set.mem += n
+	a.pendingBytes += n
+
+	if set.got < len(set.chunks) {
+		a.evict(id)
+		return nil, false, nil
+	}
+
+	a.remove(id)
+	payload := make([]byte, 0, set.size)
+	for i := range set.chunks {
+		payload = append(payload, set.chunks[i]...)
+	}
+	return payload, true, nil
+}
+
+// Dropped returns the number of incomplete messages discarded because
+// the limits were exceeded or they timed out.
+func (a *Reassembler) Dropped() uint64 {
+	return atomic.LoadUint64(&a.dropped)
+}
+
+// Pending returns the messages that are incomplete, oldest first.  The
+// result is a copy that is safe to keep.
+func (a *Reassembler) Pending() []PendingMessage {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	pending := make([]PendingMessage, 0, a.pendingOrder.Len())
+	for e := a.pendingOrder.Front(); e != nil; e = e.Next() {
+		set := e.Value.(*chunkSet)
+		pending = append(pending, PendingMessage{
+			ID:       []byte(set.id),
+			Received: set.got,
+			Total:    len(set.chunks),
+		})
+	}
+	return pending
+}
+
+// expire discards the incomplete messages that timed out by now.
+func (a *Reassembler) expire(now time.Time) {
+	if a.Timeout <= 0 {
+		return
+	}
+	for a.pendingOrder.Len() > 0 {
+		set := a.pendingOrder.Front().Value.(*chunkSet)
+		if now.Sub(set.started) <= a.Timeout {
+			return
+		}
+		a.remove(set.id)
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// evict discards the oldest incomplete messages, other than keep,
+// until the pending limits are satisfied.
+func (a *Reassembler) evict(keep string) {
+	for a.pendingOrder.Len() > 1 &&
+		((a.MaxPendingMessages > 0 && a.pendingOrder.Len() > a.MaxPendingMessages) ||
+			(a.MaxPendingBytes > 0 && a.pendingBytes > a.MaxPendingBytes)) {
+		e := a.pendingOrder.Front()
+		if e.Value.(*chunkSet).id == keep {
+			e = e.Next()
+		}
+		a.remove(e.Value.(*chunkSet).id)
+		atomic.AddUint64(&a.dropped, 1)
+	}
+}
+
+// remove forgets the pending message with the given id.
+func (a *Reassembler) remove(id string) {
+	set, ok := a.pending[id]
+	if !ok {
+		return
+	}
+	delete(a.pending, id)
+	a.pendingOrder.Remove(set.elem)
+	a.pendingBytes -= set.mem
+}
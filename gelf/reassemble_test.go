@@ -0,0 +1,99 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// tests reassembling the output of Chunk, out of order
+func TestReassembler(t *testing.T) {
+	payload := bytes.Repeat([]byte("0123456789"), 25)
+	chunks, err := Chunk([]byte{1, 2, 3, 4, 5, 6, 7, 8}, payload, 100)
+	if err != nil {
+		t.Errorf("Chunk: %s", err)
+		return
+	}
+
+	var a Reassembler
+	for _, i := range []int{2, 0, 0} {
+		if complete, done, err := a.Add(chunks[i]); err != nil || done || complete != nil {
+			t.Errorf("Add(chunk %d): got %q, %t, %v", i, complete, done, err)
+			return
+		}
+	}
+	complete, done, err := a.Add(chunks[1])
+	if err != nil || !done {
+		t.Errorf("Add(last chunk): got %t, %v", done, err)
+		return
+	}
+	if !bytes.Equal(complete, payload) {
+		t.Errorf("expected %q, got %q", payload, complete)
+	}
+	if len(a.Pending()) != 0 {
+		t.Errorf("completed message still pending: %v", a.Pending())
+	}
+
+	plain := []byte(`{"short_message":"plain"}`)
+	if complete, done, err = a.Add(plain); err != nil || !done || !bytes.Equal(complete, plain) {
+		t.Errorf("Add(unchunked): got %q, %t, %v", complete, done, err)
+	}
+
+	invalid := [][]byte{
+		chunkDatagram(1, 0, 0, nil),
+		chunkDatagram(1, 2, 2, nil),
+		chunkDatagram(1, 0, 129, nil),
+		magicChunked,
+	}
+	for _, datagram := range invalid {
+		if _, _, err = a.Add(datagram); err == nil {
+			t.Errorf("Add(%v) didn't fail", datagram)
+		}
+	}
+	a.Add(chunkDatagram(2, 0, 2, nil))
+	if _, _, err = a.Add(chunkDatagram(2, 1, 3, nil)); err == nil {
+		t.Errorf("Add of a chunk with a different total didn't fail")
+	}
+}
+
+// tests that incomplete messages are discarded after Timeout
+func TestReassemblerTimeout(t *testing.T) {
+	a := Reassembler{Timeout: 20 * time.Millisecond}
+	a.Add(chunkDatagram(1, 0, 2, []byte("stale")))
+	time.Sleep(50 * time.Millisecond)
+	a.Add(chunkDatagram(2, 0, 2, []byte("fresh")))
+
+	pending := a.Pending()
+	if len(pending) != 1 || !bytes.Equal(pending[0].ID, []byte{0, 0, 0, 0, 0, 0, 0, 2}) {
+		t.Errorf("expected only the fresh message pending, got %v", pending)
+	}
+	if a.Dropped() != 1 {
+		t.Errorf("expected 1 dropped message, got %d", a.Dropped())
+	}
+}
+
+// tests that MaxPendingBytes bounds a flood of tiny chunks of messages
+// declaring the most chunks
+func TestReassemblerTinyChunks(t *testing.T) {
+	a := Reassembler{MaxPendingBytes: 64 << 10}
+	for id := uint64(0); id < 10000; id++ {
+		if _, _, err := a.Add(chunkDatagram(id, 0, maxChunks, []byte{'x'})); err != nil {
+			t.Errorf("Add: %s", err)
+			return
+		}
+	}
+
+	if a.pendingBytes > a.MaxPendingBytes {
+		t.Errorf("%d pending bytes, limit %d", a.pendingBytes, a.MaxPendingBytes)
+	}
+	if max := a.MaxPendingBytes / (maxChunks * chunkHeaderSize); len(a.pending) > max {
+		t.Errorf("%d pending messages, expected at most %d", len(a.pending), max)
+	}
+	if len(a.pending) != a.pendingOrder.Len() || a.Dropped() != uint64(10000-len(a.pending)) {
+		t.Errorf("%d pending messages, %d in order, %d dropped", len(a.pending), a.pendingOrder.Len(), a.Dropped())
+	}
+}
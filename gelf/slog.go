@@ -0,0 +1,87 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package gelf
+
+import (
+	"log/slog"
+	"time"
+)
+
+// MessageFromSlogRecord converts a log/slog record to a message, to be
+// sent with WriteMessage or by a slog.Handler built on it.  The level
+// is mapped with levels, or SlogLevels if it is nil, the record message
+// becomes the short message and the attributes additional fields:
+// "user"="alice" in group "req" is sent as "_req_user", a valid field
+// name.  Attributes of a group without a key are inlined, empty groups
+// and attributes are left out, as slog.Handler asks for.  The host is
+// left for the Writer to fill in.
+//
+// Strings, bools and numbers keep their type, durations are sent as
+// milliseconds, like the durations of Writer.Times, times as Unix
+// timestamps like the timestamp field, errors as their message and
+// other values as they encode to JSON.  slog.LogValuer values are
+// resolved first.
+func MessageFromSlogRecord(r slog.Record, levels LevelMapper) *Message {
+	if levels == nil {
+		levels = SlogLevels
+	}
+	m := &Message{
+		Version: "1.1",
+		Short:   r.Message,
+		Level:   levels(int(r.Level)),
+	}
+	if !r.Time.IsZero() {
+		m.TimeUnix = float64(r.Time.UnixNano()) / float64(time.Second)
+	}
+	if r.NumAttrs() > 0 {
+		m.Extra = make(map[string]interface{}, r.NumAttrs())
+		r.Attrs(func(a slog.Attr) bool {
+			addSlogAttr(m.Extra, "_", a)
+			return true
+		})
+	}
+	return m
+}
+
+// addSlogAttr adds a to extra, with its key prefixed by prefix.
+func addSlogAttr(extra map[string]interface{}, prefix string, a slog.Attr) {
+	v := a.Value.Resolve()
+	if a.Key == "" && v.Kind() != slog.KindGroup {
+		return
+	}
+
+	switch v.Kind() {
+	case slog.KindGroup:
+		if a.Key != "" {
+			prefix += a.Key + "_"
+		}
+		for _, ga := range v.Group() {
+			addSlogAttr(extra, prefix, ga)
+		}
+		return
+	case slog.KindString:
+		extra[prefix+a.Key] = v.String()
+	case slog.KindInt64:
+		extra[prefix+a.Key] = v.Int64()
+	case slog.KindUint64:
+		extra[prefix+a.Key] = v.Uint64()
+	case slog.KindFloat64:
+		extra[prefix+a.Key] = v.Float64()
+	case slog.KindBool:
+		extra[prefix+a.Key] = v.Bool()
+	case slog.KindDuration:
+		extra[prefix+a.Key] = float64(v.Duration()) / float64(time.Millisecond)
+	case slog.KindTime:
+		extra[prefix+a.Key] = float64(v.Time().UnixNano()) / float64(time.Second)
+	default:
+		if err, ok := v.Any().(error); ok {
+			extra[prefix+a.Key] = err.Error()
+		} else {
+			extra[prefix+a.Key] = v.Any()
+		}
+	}
+}
@@ -0,0 +1,76 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build go1.21
+
+package gelf
+
+import (
+	"errors"
+	"log/slog"
+	"reflect"
+	"testing"
+	"time"
+)
+
+type secret string
+
+func (secret) LogValue() slog.Value { return slog.StringValue("redacted") }
+
+func TestMessageFromSlogRecord(t *testing.T) {
+	ts := time.Unix(1500000000, 500000000)
+	r := slog.NewRecord(ts, slog.LevelWarn, "slogged", 0)
+	r.AddAttrs(
+		slog.String("user", "alice"),
+		slog.Int("count", 3),
+		slog.Uint64("big", 1<<63),
+		slog.Float64("ratio", 0.5),
+		slog.Bool("ok", true),
+		slog.Duration("took", 1500*time.Millisecond),
+		slog.Time("at", ts),
+		slog.Any("err", errors.New("boom")),
+		slog.Any("password", secret("hunter2")),
+		slog.Any("tags", []string{"a", "b"}),
+		slog.Group("req", slog.String("method", "GET"), slog.Group("peer", slog.Int("port", 80))),
+		slog.Group("", slog.String("inlined", "yes")),
+		slog.Group("empty"),
+		slog.Attr{},
+	)
+
+	m := MessageFromSlogRecord(r, nil)
+	if m.Version != "1.1" || m.Short != "slogged" || m.Level != LOG_WARNING || m.TimeUnix != 1500000000.5 {
+		t.Errorf("unexpected standard fields %+v", m)
+	}
+	expected := map[string]interface{}{
+		"_user":          "alice",
+		"_count":         int64(3),
+		"_big":           uint64(1 << 63),
+		"_ratio":         0.5,
+		"_ok":            true,
+		"_took":          1500.0,
+		"_at":            1500000000.5,
+		"_err":           "boom",
+		"_password":      "redacted",
+		"_tags":          []string{"a", "b"},
+		"_req_method":    "GET",
+		"_req_peer_port": int64(80),
+		"_inlined":       "yes",
+	}
+	if !reflect.DeepEqual(m.Extra, expected) {
+		t.Errorf("expected %v, got %v", expected, m.Extra)
+	}
+	for k := range m.Extra {
+		if !ValidFieldName(k) {
+			t.Errorf("invalid field name %q", k)
+		}
+	}
+
+	if m = MessageFromSlogRecord(slog.NewRecord(time.Time{}, slog.LevelDebug, "bare", 0), nil); m.Extra != nil || m.TimeUnix != 0 || m.Level != LOG_DEBUG {
+		t.Errorf("unexpected message without attributes %+v", m)
+	}
+	custom := func(level int) int32 { return LOG_NOTICE }
+	if m = MessageFromSlogRecord(slog.NewRecord(ts, slog.LevelInfo, "mapped", 0), custom); m.Level != LOG_NOTICE {
+		t.Errorf("expected the custom mapper's LOG_NOTICE, got %d", m.Level)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package gelf
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+)
+
+// socketError returns the pending error of the socket w writes to
+// (SO_ERROR), if w is a socket.  Reading the error clears it.
+func socketError(w io.Writer) error {
+	sc, ok := w.(syscall.Conn)
+	if !ok {
+		return nil
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var soErr int
+	err = c.Control(func(fd uintptr) {
+		soErr, err = syscall.GetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_ERROR)
+	})
+	if err != nil {
+		return err
+	}
+	if soErr != 0 {
+		return syscall.Errno(soErr)
+	}
+	return nil
+}
+
+// setTrafficClass sets the IPv4 type of service (IP_TOS) or the IPv6
+// traffic class (IPV6_TCLASS) of the socket conn uses, whichever its
+// local address calls for.
+func setTrafficClass(conn net.Conn, tc int) error {
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("can't set traffic class on %T", conn)
+	}
+	c, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	level, opt := syscall.IPPROTO_IP, syscall.IP_TOS
+	if udpAddr, ok := conn.LocalAddr().(*net.UDPAddr); ok && udpAddr.IP.To4() == nil {
+		level, opt = syscall.IPPROTO_IPV6, syscall.IPV6_TCLASS
+	}
+	cErr := c.Control(func(fd uintptr) {
+		err = syscall.SetsockoptInt(int(fd), level, opt, tc)
+	})
+	if cErr != nil {
+		return cErr
+	}
+	if err != nil {
+		return fmt.Errorf("setsockopt: %s", err)
+	}
+	return nil
+}
@@ -0,0 +1,23 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !(darwin || dragonfly || freebsd || linux || netbsd || openbsd)
+
+package gelf
+
+import (
+	"errors"
+	"io"
+	"net"
+)
+
+// socketError can't check sockets on this platform.
+func socketError(w io.Writer) error {
+	return nil
+}
+
+// setTrafficClass can't set the traffic class on this platform.
+func setTrafficClass(conn net.Conn, tc int) error {
+	return errors.New("setting the traffic class is not supported on this platform")
+}
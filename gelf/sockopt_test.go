@@ -0,0 +1,73 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+
+package gelf
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// tosOf returns the IP_TOS of the socket of w.
+func tosOf(t *testing.T, w *Writer) int {
+	raw, err := w.Conn().(*net.UDPConn).SyscallConn()
+	if err != nil {
+		t.Errorf("SyscallConn: %s", err)
+		return -1
+	}
+	tos := -1
+	raw.Control(func(fd uintptr) {
+		tos, _ = syscall.GetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_TOS)
+	})
+	return tos
+}
+
+func TestSetTrafficClass(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	defer w.Close()
+
+	const cs1 = 8 << 2
+	if err = w.SetTrafficClass(cs1); err != nil {
+		t.Errorf("SetTrafficClass: %s", err)
+		return
+	}
+	if tos := tosOf(t, w); tos != cs1 || w.TrafficClass() != cs1 {
+		t.Errorf("expected traffic class %d, got %d on the socket and %d", cs1, tos, w.TrafficClass())
+	}
+
+	if err = w.SetAddr(r.Addr()); err != nil {
+		t.Errorf("SetAddr: %s", err)
+		return
+	}
+	if tos := tosOf(t, w); tos != cs1 {
+		t.Errorf("expected traffic class %d after SetAddr, got %d", cs1, tos)
+	}
+	if _, err = w.Write([]byte("low priority")); err != nil {
+		t.Errorf("Write: %s", err)
+		return
+	}
+	if _, err = r.ReadMessage(); err != nil {
+		t.Errorf("ReadMessage: %s", err)
+	}
+
+	for _, tc := range []int{-1, 256} {
+		if err = w.SetTrafficClass(tc); err == nil {
+			t.Errorf("SetTrafficClass(%d) didn't fail", tc)
+		}
+	}
+}
@@ -0,0 +1,179 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// SpoolWriter sends messages through an inner Writer and keeps the
+// ones that fail to send in a spool file on disk.  Spooled messages are
+// sent again, oldest first, before the next message or on Flush, so
+// they get delivered once the network is reachable again.
+//
+// The spool file holds null-delimited JSON frames, like a StreamWriter
+// produces.  Entries that cannot be decoded, such as one cut short by
+// a crash, are skipped when replaying.
+type SpoolWriter struct {
+	dropped uint64 // accessed atomically, keep 64-bit aligned
+	expired uint64 // accessed atomically, keep 64-bit aligned
+
+	// MaxAge, when non-zero, is how old a spooled message may get
+	// before it is no longer worth sending.  Older messages, going by
+	// their TimeUnix, are dropped when replaying the spool and
+	// counted in Expired.  Messages without a timestamp never expire.
+	MaxAge time.Duration
+
+	mu       sync.Mutex
+	inner    *Writer
+	path     string
+	maxBytes int64
+}
+
+// NewSpoolWriter returns a SpoolWriter sending through inner and
+// spooling to a file in dir, which is created if necessary.  The spool
+// file never grows beyond maxBytes; messages that don't fit anymore are
+// dropped.
+func NewSpoolWriter(inner *Writer, dir string, maxBytes int64) (*SpoolWriter, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+
+	s := &SpoolWriter{
+		inner:    inner,
+		path:     filepath.Join(dir, "spool.gelf"),
+		maxBytes: maxBytes,
+	}
+	return s, nil
+}
+
+// WriteMessage sends m after any spooled messages.  If that fails, m is
+// appended to the spool and nil is returned; an error is only returned
+// if m could be neither sent nor spooled.
+func (s *SpoolWriter) WriteMessage(m *Message) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err := s.replay(); err == nil {
+		if err = s.inner.WriteMessage(m); err == nil {
+			return nil
+		}
+	}
+	return s.spool(m)
+}
+
+// Flush sends the spooled messages, stopping at the first one that
+// fails to send.
+func (s *SpoolWriter) Flush() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.replay()
+}
+
+// Dropped returns the number of messages that were dropped because the
+// spool was full.
+func (s *SpoolWriter) Dropped() uint64 {
+	return atomic.LoadUint64(&s.dropped)
+}
+
+// Expired returns the number of spooled messages that were dropped
+// because they were older than MaxAge.
+func (s *SpoolWriter) Expired() uint64 {
+	return atomic.LoadUint64(&s.expired)
+}
+
+// Close closes the inner Writer.  Messages still in the spool stay on
+// disk and are sent by the next SpoolWriter using the same directory.
+func (s *SpoolWriter) Close() error {
+	return s.inner.Close()
+}
+
+// spool appends m to the spool file.
+func (s *SpoolWriter) spool(m *Message) error {
+	mBuf := newBuffer()
+	defer bufPool.Put(mBuf)
+	if err := m.MarshalJSONBuf(mBuf); err != nil {
+		return err
+	}
+	mBuf.WriteByte(0)
+
+	var size int64
+	if fi, err := os.Stat(s.path); err == nil {
+		size = fi.Size()
+	}
+	if size+int64(mBuf.Len()) > s.maxBytes {
+		atomic.AddUint64(&s.dropped, 1)
+		return fmt.Errorf("spool full (%d/%d bytes)", size, s.maxBytes)
+	}
+
+	f, err := os.OpenFile(s.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(mBuf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// replay sends the spooled messages in order.  The ones left after a
+// failed send are written back to the spool.
+func (s *SpoolWriter) replay() error {
+	data, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var oldest float64
+	if s.MaxAge > 0 {
+		oldest = float64(time.Now().Add(-s.MaxAge).UnixNano()) / float64(time.Second)
+	}
+
+	frames := bytes.Split(data, []byte{0})
+	for i, frame := range frames {
+		if len(frame) == 0 {
+			continue
+		}
+		m, err := decodeMessage(frame)
+		if err != nil {
+			// skip corrupt entries
+			continue
+		}
+		if m.TimeUnix > 0 && m.TimeUnix < oldest {
+			atomic.AddUint64(&s.expired, 1)
+			continue
+		}
+		if err = s.inner.WriteMessage(m); err != nil {
+			return s.rewrite(bytes.Join(frames[i:], []byte{0}), err)
+		}
+	}
+
+	return os.Remove(s.path)
+}
+
+// rewrite atomically replaces the spool file with data, returning
+// sendErr unless the replacement fails.
+func (s *SpoolWriter) rewrite(data []byte, sendErr error) error {
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return err
+	}
+	return sendErr
+}
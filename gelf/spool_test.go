@@ -0,0 +1,175 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// errRefused is the error of a collector that is down.
+var errRefused = errors.New("connection refused")
+
+// tests that messages failing to send are spooled and replayed in order
+func TestSpoolWriter(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	conn := &failingConn{Conn: w.conn, err: errRefused, fails: 1 << 20}
+	w.conn = conn
+
+	dir := t.TempDir()
+	s, err := NewSpoolWriter(w, dir, 1<<20)
+	if err != nil {
+		t.Errorf("NewSpoolWriter: %s", err)
+		return
+	}
+	defer s.Close()
+
+	for i := 0; i < 3; i++ {
+		m := Message{Version: "1.1", Host: "h", Short: fmt.Sprintf("msg %d", i), TimeUnix: float64(i)}
+		if err = s.WriteMessage(&m); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+	}
+
+	// a partially written entry must not stop the replay
+	f, err := os.OpenFile(filepath.Join(dir, "spool.gelf"), os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Errorf("OpenFile: %s", err)
+		return
+	}
+	f.Write([]byte(`{"version":"1.1","sho` + "\x00"))
+	f.Close()
+
+	conn.fails = 0
+	m := Message{Version: "1.1", Host: "h", Short: "msg 3", TimeUnix: 3}
+	if err = s.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+
+	for i := 0; i < 4; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if expected := fmt.Sprintf("msg %d", i); msg.Short != expected || msg.TimeUnix != float64(i) {
+			t.Errorf("expected %s at %d, got %s at %v", expected, i, msg.Short, msg.TimeUnix)
+			return
+		}
+	}
+
+	if _, err = os.Stat(filepath.Join(dir, "spool.gelf")); !os.IsNotExist(err) {
+		t.Errorf("spool file not removed after replay: %v", err)
+	}
+}
+
+// tests that the spool doesn't grow beyond its limit
+func TestSpoolWriterFull(t *testing.T) {
+	w, err := NewWriter("127.0.0.1:12201", "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.conn = &failingConn{Conn: w.conn, err: errRefused, fails: 1 << 20}
+
+	dir := t.TempDir()
+	s, err := NewSpoolWriter(w, dir, 200)
+	if err != nil {
+		t.Errorf("NewSpoolWriter: %s", err)
+		return
+	}
+	defer s.Close()
+
+	var failed int
+	for i := 0; i < 10; i++ {
+		m := Message{Version: "1.1", Host: "h", Short: fmt.Sprintf("msg %d", i)}
+		if err = s.WriteMessage(&m); err != nil {
+			failed++
+		}
+	}
+	if failed == 0 || uint64(failed) != s.Dropped() {
+		t.Errorf("expected dropped messages, got %d errors and %d dropped", failed, s.Dropped())
+	}
+
+	data, err := ioutil.ReadFile(filepath.Join(dir, "spool.gelf"))
+	if err != nil {
+		t.Errorf("ReadFile: %s", err)
+		return
+	}
+	if len(data) > 200 {
+		t.Errorf("spool grew to %d bytes, limit 200", len(data))
+	}
+}
+
+// tests that spooled messages older than MaxAge are not sent
+func TestSpoolWriterMaxAge(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	conn := &failingConn{Conn: w.conn, err: errRefused, fails: 1 << 20}
+	w.conn = conn
+
+	s, err := NewSpoolWriter(w, t.TempDir(), 1<<20)
+	if err != nil {
+		t.Errorf("NewSpoolWriter: %s", err)
+		return
+	}
+	defer s.Close()
+	s.MaxAge = time.Minute
+
+	now := float64(time.Now().Unix())
+	for _, ts := range []float64{now - 3600, now - 120, now} {
+		m := Message{Version: "1.1", Host: "h", Short: fmt.Sprintf("at %v", ts), TimeUnix: ts}
+		if err = s.WriteMessage(&m); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+	}
+
+	conn.fails = 0
+	if err = s.Flush(); err != nil {
+		t.Errorf("Flush: %s", err)
+		return
+	}
+	if s.Expired() != 2 {
+		t.Errorf("expected 2 expired messages, got %d", s.Expired())
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.TimeUnix != now {
+		t.Errorf("expected the message at %v, got %s", now, msg.Short)
+	}
+}
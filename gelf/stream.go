@@ -0,0 +1,241 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"sync"
+)
+
+// StreamReader reads GELF messages from a byte stream, such as a file,
+// pipe or TCP connection, where each message is a JSON document
+// terminated by a null byte.
+type StreamReader struct {
+	// Delimiter is the byte terminating frames.  It defaults to the
+	// null byte; set it to '\n' to read newline-delimited JSON.
+	Delimiter byte
+
+	// Decompress makes the reader accept frames compressed with gzip
+	// or zlib, as some producers send them although Graylog doesn't,
+	// and decompress them, telling them from plain JSON frames by
+	// their magic bytes.  Compressed data may contain the delimiter,
+	// so such a frame ends where its compressed data does, which
+	// must be followed by the delimiter.  A compressed frame that is
+	// corrupt, or longer than maxInflateFrame bytes, fails
+	// ReadMessage, and reading resumes at the next delimiter.
+	Decompress bool
+
+	r *bufio.Reader
+}
+
+// maxInflateFrame is the most bytes of compressed data a frame may
+// have, so that a truncated frame doesn't swallow the stream.
+const maxInflateFrame = 1 << 20
+
+// NewReaderFromStream returns a StreamReader reading null-delimited
+// GELF frames from r.
+func NewReaderFromStream(r io.Reader) *StreamReader {
+	return &StreamReader{r: bufio.NewReader(r)}
+}
+
+// ReadMessage returns the next message in the stream.  Frames may be
+// split across reads of the underlying reader.  A trailing frame that
+// is not null-terminated is decoded as the last message; afterwards
+// io.EOF is returned.
+func (s *StreamReader) ReadMessage() (*Message, error) {
+	for {
+		if s.Decompress {
+			if head, _ := s.r.Peek(2); isCompressed(head) {
+				data, err := s.inflate()
+				if err != nil {
+					return nil, err
+				}
+				return decodeMessage(data)
+			}
+		}
+
+		frame, err := s.r.ReadBytes(s.Delimiter)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		frame = bytes.TrimSuffix(frame, []byte{s.Delimiter})
+
+		if len(bytes.TrimSpace(frame)) == 0 {
+			if err == io.EOF {
+				return nil, io.EOF
+			}
+			// skip empty frames
+			continue
+		}
+		return decodeMessage(frame)
+	}
+}
+
+// inflate decompresses the compressed frame the stream is at, reading
+// no more than the compressed data, and then skips to the end of the
+// frame.
+func (s *StreamReader) inflate() ([]byte, error) {
+	lr := &limitedByteReader{r: s.r, n: maxInflateFrame}
+	var (
+		zr  io.Reader
+		err error
+	)
+	if head, _ := s.r.Peek(2); bytes.Equal(head, magicGzip) {
+		var gr *gzip.Reader
+		if gr, err = gzip.NewReader(lr); err == nil {
+			// a frame holds one gzip member
+			gr.Multistream(false)
+			zr = gr
+		}
+	} else {
+		zr, err = zlib.NewReader(lr)
+	}
+	var data []byte
+	if err == nil {
+		data, err = ioutil.ReadAll(zr)
+	}
+	if err != nil {
+		err = fmt.Errorf("decompress: %w", err)
+	}
+
+	rest, rErr := s.r.ReadBytes(s.Delimiter)
+	if err == nil && rErr != nil && rErr != io.EOF {
+		err = rErr
+	}
+	if rest = bytes.TrimSuffix(rest, []byte{s.Delimiter}); err == nil && len(bytes.TrimSpace(rest)) > 0 {
+		err = fmt.Errorf("%d bytes after the compressed data of a frame", len(rest))
+	}
+	return data, err
+}
+
+// limitedByteReader reads up to n bytes from r.  It is an io.ByteReader,
+// so that the decompressors read no more than they need.
+type limitedByteReader struct {
+	r *bufio.Reader
+	n int
+}
+
+func (l *limitedByteReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		return 0, errFrameTooLong
+	}
+	if len(p) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= n
+	return n, err
+}
+
+func (l *limitedByteReader) ReadByte() (byte, error) {
+	if l.n <= 0 {
+		return 0, errFrameTooLong
+	}
+	l.n--
+	return l.r.ReadByte()
+}
+
+// errFrameTooLong is returned for compressed frames of more than
+// maxInflateFrame bytes.
+var errFrameTooLong = fmt.Errorf("compressed frame exceeds %d bytes", maxInflateFrame)
+
+// StreamWriter writes GELF messages to a byte stream as null-delimited
+// JSON frames.  Frames are never compressed, matching what Graylog
+// expects on its TCP input: it splits the stream at null bytes, which
+// compressed data is full of.
+//
+// On a TCP connection, a successful write only means the kernel took
+// the frame into its send buffer.  It may still be lost if the
+// connection breaks before the peer gets it, and TCP reports that on a
+// later write at the earliest; GELF has no acknowledgements to tell
+// otherwise.  Set Confirm to learn about a broken connection as soon
+// as the kernel does.
+type StreamWriter struct {
+	// Delimiter is the byte terminating frames.  It defaults to the
+	// null byte Graylog expects; set it to '\n' to write
+	// newline-delimited JSON (NDJSON), which collectors such as
+	// Fluentd and Vector prefer.  Newlines in messages are escaped in
+	// the JSON, so they never end a frame early.
+	Delimiter byte
+
+	// Confirm makes WriteMessage check, after writing a frame, that
+	// the connection isn't in an error state, such as having been
+	// reset by the peer, and fail with that error if it is.  It
+	// costs a system call per message and only applies to
+	// connections of the platforms that report such errors, the
+	// Unix ones.  It still doesn't mean the peer got the frame.
+	Confirm bool
+
+	mu  sync.Mutex
+	w   io.Writer
+	err error // sticky write error
+}
+
+// NewStreamWriter returns a StreamWriter writing frames to w.
+func NewStreamWriter(w io.Writer) *StreamWriter {
+	return &StreamWriter{w: w}
+}
+
+// WriteMessage writes m to the stream as a single frame.  It fails if m
+// asks for a Compression other than CompressNone, rather than write a
+// frame the other end can't read.  It is safe for concurrent use.
+//
+// Once a write has failed, part of a frame may have been written, which
+// would garble the frames after it, so every later WriteMessage fails
+// with the same error.  Open a new StreamWriter on a new connection to
+// carry on.
+func (s *StreamWriter) WriteMessage(m *Message) error {
+	if m.Compression != nil && *m.Compression != CompressNone {
+		return fmt.Errorf("%s compression requested, but stream frames are never compressed", *m.Compression)
+	}
+
+	mBuf := newBuffer()
+	defer bufPool.Put(mBuf)
+	if err := m.MarshalJSONBuf(mBuf); err != nil {
+		return err
+	}
+	if s.Delimiter == '\n' && bytes.IndexByte(mBuf.Bytes(), '\n') >= 0 {
+		// RawExtra may contain newlines outside of strings
+		compact := newBuffer()
+		defer bufPool.Put(compact)
+		if err := json.Compact(compact, mBuf.Bytes()); err != nil {
+			return err
+		}
+		mBuf, compact = compact, mBuf
+	}
+	mBuf.WriteByte(s.Delimiter)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	n, err := s.w.Write(mBuf.Bytes())
+	if err == nil && n != mBuf.Len() {
+		err = fmt.Errorf("bad write (%d/%d)", n, mBuf.Len())
+	}
+	if err == nil && s.Confirm {
+		if err = socketError(s.w); err != nil {
+			err = fmt.Errorf("connection error: %s", err)
+		}
+	}
+	s.err = err
+	return err
+}
+
+// Close closes the underlying writer if it implements io.Closer.
+func (s *StreamWriter) Close() error {
+	if c, ok := s.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
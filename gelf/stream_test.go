@@ -0,0 +1,325 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestStreamReader(t *testing.T) {
+	stream := `{"version":"1.1","host":"h","short_message":"one"}` + "\x00" +
+		"\x00" +
+		`{"version":"1.1","host":"h","short_message":"two","_a":1}` + "\x00" +
+		`{"version":"1.1","host":"h","short_message":"three"}`
+
+	// read one byte at a time so that frames are split across reads
+	r := NewReaderFromStream(iotest.OneByteReader(strings.NewReader(stream)))
+
+	for _, expected := range []string{"one", "two", "three"} {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Short != expected {
+			t.Errorf("msg.Short: expected %s, got %s", expected, msg.Short)
+			return
+		}
+		if expected == "two" && msg.Extra["_a"] != float64(1) {
+			t.Errorf("_a didn't roundtrip: %v", msg.Extra)
+			return
+		}
+	}
+
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+func TestStreamReaderBadFrame(t *testing.T) {
+	r := NewReaderFromStream(strings.NewReader(`{"short_message":` + "\x00"))
+	if _, err := r.ReadMessage(); err == nil {
+		t.Errorf("ReadMessage of a truncated frame didn't fail")
+	}
+}
+
+// tests that Decompress reads gzip and zlib frames, whose compressed
+// data contains null bytes, between plain ones
+func TestStreamReaderDecompress(t *testing.T) {
+	var stream bytes.Buffer
+	for i, ctype := range []CompressType{CompressNone, CompressGzip, CompressZlib, CompressNone} {
+		frame := fmt.Sprintf(`{"version":"1.1","host":"h","short_message":"frame %d","full_message":%q}`,
+			i, strings.Repeat("padding ", 100))
+		zBytes, err := compress([]byte(frame), new(bytes.Buffer), ctype, flate.BestSpeed)
+		if err != nil {
+			t.Errorf("compress: %s", err)
+			return
+		}
+		if ctype == CompressGzip && bytes.IndexByte(zBytes, 0) < 0 {
+			t.Errorf("expected null bytes in the gzip data")
+			return
+		}
+		stream.Write(zBytes)
+		stream.WriteByte(0)
+	}
+	data := stream.Bytes()
+
+	r := NewReaderFromStream(bytes.NewReader(data))
+	r.Decompress = true
+	for i := 0; i < 4; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if expected := fmt.Sprintf("frame %d", i); msg.Short != expected {
+			t.Errorf("expected %s, got %s", expected, msg.Short)
+		}
+	}
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+
+	r = NewReaderFromStream(bytes.NewReader(data))
+	if _, err := r.ReadMessage(); err != nil {
+		t.Errorf("ReadMessage of the plain frame: %s", err)
+		return
+	}
+	if _, err := r.ReadMessage(); err == nil {
+		t.Errorf("expected compressed frames to fail without Decompress")
+	}
+}
+
+// tests that corrupt compressed frames fail on their own, without
+// taking the frames after them along
+func TestStreamReaderCorruptFrame(t *testing.T) {
+	plain := `{"version":"1.1","host":"h","short_message":"plain %d"}` + "\x00"
+	gzipped, err := compress([]byte(fmt.Sprintf(plain, 9)), new(bytes.Buffer), CompressGzip, flate.BestSpeed)
+	if err != nil {
+		t.Errorf("compress: %s", err)
+		return
+	}
+	badChecksum := append([]byte(nil), gzipped...)
+	badChecksum[len(badChecksum)-5] ^= 0xff
+
+	// a frame that never ends: non-final stored deflate blocks full
+	// of null bytes, beyond maxInflateFrame
+	endless := append([]byte(nil), gzipped[:10]...)
+	for len(endless) <= maxInflateFrame {
+		endless = append(endless, 0, 0xff, 0xff, 0, 0)
+		endless = append(endless, make([]byte, 0xffff)...)
+	}
+
+	var stream bytes.Buffer
+	stream.Write(badChecksum)
+	stream.WriteByte(0)
+	fmt.Fprintf(&stream, plain, 0)
+	stream.WriteString("\x1f\x8bnot really gzip\x00")
+	fmt.Fprintf(&stream, plain, 1)
+	stream.Write(gzipped[:len(gzipped)-8])
+	stream.WriteString(`{"trailing":"junk"}` + "\x00")
+	fmt.Fprintf(&stream, plain, 2)
+	stream.Write(endless)
+	stream.WriteString("\x00\x00")
+	fmt.Fprintf(&stream, plain, 3)
+
+	r := NewReaderFromStream(&stream)
+	r.Decompress = true
+	var got []string
+	for i := 0; i < 100; i++ {
+		msg, err := r.ReadMessage()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			got = append(got, "error")
+			continue
+		}
+		got = append(got, msg.Short)
+	}
+	expected := []string{"error", "plain 0", "error", "plain 1", "error", "plain 2", "error", "plain 3"}
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("expected %v, got %v", expected, got)
+	}
+}
+
+func TestStreamWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewStreamWriter(&buf)
+
+	sent := []Message{
+		{Version: "1.1", Host: "h", Short: "one", Full: "one\nwith detail", TimeUnix: 1},
+		{Version: "1.1", Host: "h", Short: "two", TimeUnix: 2, Extra: map[string]interface{}{"_a": "b"}},
+	}
+	for i := range sent {
+		if err := w.WriteMessage(&sent[i]); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+	}
+
+	if n := bytes.Count(buf.Bytes(), []byte{0}); n != len(sent) {
+		t.Errorf("expected %d null bytes, got %d", len(sent), n)
+		return
+	}
+	frames := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte{0}), []byte{0})
+	for _, frame := range frames {
+		if !json.Valid(frame) {
+			t.Errorf("frame isn't plain JSON: %q", frame)
+		}
+	}
+
+	gzip := CompressGzip
+	if err := w.WriteMessage(&Message{Short: "compressed", Compression: &gzip}); err == nil {
+		t.Errorf("WriteMessage with gzip compression didn't fail")
+	}
+
+	r := NewReaderFromStream(&buf)
+	for i := range sent {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Short != sent[i].Short || msg.Full != sent[i].Full || msg.TimeUnix != sent[i].TimeUnix {
+			t.Errorf("message didn't roundtrip: expected %+v, got %+v", sent[i], msg)
+			return
+		}
+	}
+	if _, err := r.ReadMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %v", err)
+	}
+}
+
+// tests that a failed write makes later writes fail too
+func TestStreamWriterStickyError(t *testing.T) {
+	failing := errors.New("disk full")
+	m := Message{Version: "1.1", Host: "h", Short: "failed"}
+	w := NewStreamWriter(&failOnceWriter{err: failing})
+	if err := w.WriteMessage(&m); err != failing {
+		t.Errorf("expected %v, got %v", failing, err)
+	}
+	if err := w.WriteMessage(&m); err != failing {
+		t.Errorf("expected %v again, got %v", failing, err)
+	}
+}
+
+// failOnceWriter fails the first write, like a transient error that
+// leaves a partial frame behind.
+type failOnceWriter struct {
+	err    error
+	failed bool
+}
+
+func (w *failOnceWriter) Write(p []byte) (int, error) {
+	if !w.failed {
+		w.failed = true
+		return len(p) / 2, w.err
+	}
+	return len(p), nil
+}
+
+// tests that Confirm reports a connection reset by the peer
+func TestStreamWriterConfirm(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("Listen: %s", err)
+		return
+	}
+	defer l.Close()
+
+	conn, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Errorf("Dial: %s", err)
+		return
+	}
+	defer conn.Close()
+	peer, err := l.Accept()
+	if err != nil {
+		t.Errorf("Accept: %s", err)
+		return
+	}
+
+	w := NewStreamWriter(conn)
+	w.Confirm = true
+	m := Message{Version: "1.1", Host: "h", Short: "confirmed"}
+	if err = w.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+
+	// closing with unread data makes the peer send a reset
+	peer.(*net.TCPConn).SetLinger(0)
+	peer.Close()
+	deadline := time.Now().Add(5 * time.Second)
+	for w.WriteMessage(&m) == nil {
+		if time.Now().After(deadline) {
+			t.Errorf("WriteMessage kept succeeding after the reset")
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// tests writing and reading newline-delimited JSON
+func TestStreamNDJSON(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewStreamWriter(&buf)
+	w.Delimiter = '\n'
+
+	sent := []Message{
+		{Version: "1.1", Host: "h", Short: "one", Full: "one\nwith\nnewlines", TimeUnix: 1},
+		{Version: "1.1", Host: "h", Short: "two", TimeUnix: 2, RawExtra: json.RawMessage("{\n\"_a\": \"b\"\n}")},
+	}
+	for i := range sent {
+		if err := w.WriteMessage(&sent[i]); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+	}
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	if len(lines) != len(sent) {
+		t.Errorf("expected %d lines, got %q", len(sent), lines)
+		return
+	}
+	for i, line := range lines {
+		var m Message
+		if err := json.Unmarshal([]byte(line), &m); err != nil {
+			t.Errorf("json.Unmarshal: %s", err)
+			return
+		}
+		if m.Short != sent[i].Short || m.Full != sent[i].Full {
+			t.Errorf("expected %+v, got %+v", sent[i], m)
+		}
+	}
+
+	r := NewReaderFromStream(&buf)
+	r.Delimiter = '\n'
+	for i := range sent {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Short != sent[i].Short {
+			t.Errorf("expected %s, got %s", sent[i].Short, msg.Short)
+		}
+	}
+	if msg, err := r.ReadMessage(); err != io.EOF {
+		t.Errorf("expected io.EOF, got %+v, %v", msg, err)
+	}
+}
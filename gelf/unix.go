@@ -0,0 +1,56 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+import (
+	"fmt"
+	"net"
+)
+
+// Unix domain sockets come in two flavours that carry GELF
+// differently, and a collector listens on only one of them:
+//
+//   - Datagram sockets ("unixgram") carry one message per datagram,
+//     split into GELF chunks when too big, just like the UDP input.
+//     Use NewUnixgramWriter for collectors with a datagram socket,
+//     such as a local relay reading with the same code as for UDP.
+//   - Stream sockets ("unix") carry null-delimited JSON frames without
+//     compression, just like the TCP input.  Use NewUnixStreamWriter
+//     for collectors with a stream socket.
+
+// NewUnixgramWriter returns a Writer sending messages as datagrams to
+// the unix domain socket at path.
+func NewUnixgramWriter(path string, appname string) (*Writer, error) {
+	w, err := newWriter("unixgram", path, appname, nil)
+	if err != nil {
+		return nil, unixDialError("unixgram", path, err)
+	}
+	return w, nil
+}
+
+// NewUnixStreamWriter returns a StreamWriter sending null-delimited
+// frames to the unix domain socket at path.
+func NewUnixStreamWriter(path string) (*StreamWriter, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, unixDialError("unix", path, err)
+	}
+	return NewStreamWriter(conn), nil
+}
+
+// unixDialError explains the error returned when the socket at path is
+// of the wrong type.
+func unixDialError(network, path string, err error) error {
+	if !isWrongSocketType(err) {
+		return err
+	}
+
+	other := "unix"
+	if network == "unix" {
+		other = "unixgram"
+	}
+	return fmt.Errorf("dial %s %s: socket is not of type %s, try the %s writer: %w",
+		network, path, network, other, err)
+}
@@ -0,0 +1,109 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !windows && !plan9
+
+package gelf
+
+import (
+	"errors"
+	"net"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestUnixgramWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		t.Errorf("ListenUnixgram: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	w, err := NewUnixgramWriter(path, "")
+	if err != nil {
+		t.Errorf("NewUnixgramWriter: %s", err)
+		return
+	}
+	defer w.Close()
+
+	if _, err = w.Write([]byte("over unixgram")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+
+	buf := make([]byte, ChunkSize)
+	n, err := conn.Read(buf)
+	if err != nil {
+		t.Errorf("Read: %s", err)
+		return
+	}
+	data, err := decompress(buf[:n])
+	if err != nil {
+		t.Errorf("decompress: %s", err)
+		return
+	}
+	msg, err := decodeMessage(data)
+	if err != nil {
+		t.Errorf("decodeMessage: %s", err)
+		return
+	}
+	if msg.Short != "over unixgram" {
+		t.Errorf("msg.Short: expected over unixgram, got %s", msg.Short)
+	}
+}
+
+func TestUnixStreamWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Errorf("Listen: %s", err)
+		return
+	}
+	defer l.Close()
+
+	w, err := NewUnixStreamWriter(path)
+	if err != nil {
+		t.Errorf("NewUnixStreamWriter: %s", err)
+		return
+	}
+	defer w.Close()
+
+	conn, err := l.Accept()
+	if err != nil {
+		t.Errorf("Accept: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "over unix"}); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+
+	msg, err := NewReaderFromStream(conn).ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "over unix" {
+		t.Errorf("msg.Short: expected over unix, got %s", msg.Short)
+	}
+}
+
+func TestUnixSocketTypeMismatch(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "gelf.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Errorf("Listen: %s", err)
+		return
+	}
+	defer l.Close()
+
+	if _, err = NewUnixgramWriter(path, ""); !errors.Is(err, syscall.EPROTOTYPE) {
+		t.Errorf("expected EPROTOTYPE dialing a stream socket, got %v", err)
+	}
+}
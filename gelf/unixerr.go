@@ -0,0 +1,18 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+//go:build !plan9
+
+package gelf
+
+import (
+	"errors"
+	"syscall"
+)
+
+// isWrongSocketType reports whether err is that of connecting to a
+// socket of another type.
+func isWrongSocketType(err error) bool {
+	return errors.Is(err, syscall.EPROTOTYPE)
+}
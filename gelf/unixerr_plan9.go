@@ -0,0 +1,12 @@
+// Copyright 2012 SocialCode. All rights reserved.
+// Use of this source code is governed by the MIT
+// license that can be found in the LICENSE file.
+
+package gelf
+
+// isWrongSocketType reports whether err is that of connecting to a
+// socket of another type.  Plan 9 has no unix domain sockets, so it
+// never is.
+func isWrongSocketType(err error) bool {
+	return false
+}
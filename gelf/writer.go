@@ -9,32 +9,450 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"compress/zlib"
+	"context"
 	"crypto/rand"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net"
 	"os"
 	"path"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
 )
 
 // Writer implements io.Writer and is used to send both discrete
 // messages to a graylog2 server, or data from a stream-oriented
 // interface (like the functions in log).
 type Writer struct {
-	mu               sync.Mutex
-	conn             net.Conn
+	*counters // Filtered, DroppedFields, NoBufferErrors and CompressionStats
+	*link     // the connection, shared with the writers made by With
+
+	fields           map[string]interface{} // added to every message, see With
+	network          string
 	hostname         string
 	optData          map[string]string
-	Facility         string // defaults to current process name
-	CompressionLevel int    // one of the consts from compress/flate
+	CompressionLevel int // one of the consts from compress/flate, see CompressionConfig
 	CompressionType  CompressType
+	AutoCompression  AutoCompression // the cutoffs of CompressAuto
+
+	// dial, when set, replaces net.Dial for connecting, so that
+	// SetAddr sets up new connections like the first one.
+	dial func(addr string) (net.Conn, error)
+
+	// Facility is set on the messages the writer creates itself, by
+	// Write and Log; messages passed to WriteMessage keep their own.
+	// It defaults to the name of the current process.  GELF 1.1
+	// deprecates the facility field, so set Facility to "" to leave
+	// it out of the JSON altogether; the writer never warns about it
+	// being used.
+	Facility string
+
+	// RoutingKey, when non-empty, is attached to every message sent
+	// by the writer as the additional field named by RoutingField.
+	// Graylog stream rules can match on it instead of relying on the
+	// deprecated facility field.
+	RoutingKey   string
+	RoutingField string // defaults to "_stream", with FieldPrefix
+
+	// MessageIDFunc, when set, generates the message id used in the
+	// headers of chunked messages instead of reading one from
+	// crypto/rand.  It must return exactly 8 bytes, and ids must not
+	// repeat while chunks of a message may still be in flight.
+	MessageIDFunc func() ([]byte, error)
+
+	// ChunkSize, when non-zero, overrides the package's ChunkSize as
+	// the largest datagram the writer sends, e.g. for networks with a
+	// smaller MTU, or to exercise chunking in tests.  It must exceed
+	// the 12 byte chunk header.  Note that a Reader only receives
+	// datagrams of up to the package's ChunkSize.
+	ChunkSize int
+
+	// TimeFunc, when set, replaces time.Now for the timestamps of
+	// the messages the writer creates itself, e.g. to get the same
+	// output in every test run.
+	TimeFunc func() time.Time
+
+	// RetryCount is the number of times a datagram is resent after
+	// a transient error caused by a full socket buffer (EAGAIN or
+	// ENOBUFS).  Other errors are returned immediately.
+	RetryCount int
+
+	// OnNoBuffer, when set, is called every time sending a datagram
+	// fails with ENOBUFS, before it is retried, if at all.  ENOBUFS
+	// means datagrams are sent faster than the network interface takes
+	// them, the most common cause of lost messages, so this is the
+	// place to tell the application to slow down.  It is called
+	// while the message is being written and must not call methods of
+	// the writer.  The errors are counted in NoBufferErrors either way.
+	OnNoBuffer func()
+
+	// CompressionFunc, when set, picks the compression type of every
+	// message without a Compression of its own, which it then works
+	// like; see UncompressedFromLevel for sending severe messages
+	// without the latency of compressing them.  It must not modify
+	// the message.
+	CompressionFunc func(m *Message) CompressType
+
+	// OnError, when set, is called with the details of every message
+	// WriteMessage, and so Write and Log, fails to send, after the
+	// message was given up on, for monitoring to report on.  The
+	// error is still returned too.  It may be called concurrently.
+	OnError func(e *SendError)
+
+	// MinLevel is the least severe level that is sent; messages with
+	// a numerically greater Level are silently dropped and counted in
+	// Filtered.  Defaults to LOG_DEBUG, so nothing is dropped.  A
+	// message without a level (0) is always sent, as Graylog treats
+	// it as LOG_ALERT.
+	MinLevel int32
+
+	// HostFunc, when set, is called for every message without a Host
+	// and its result is used instead of the hostname determined at
+	// construction.  Any caching is up to the function.  The
+	// hostname is read only once, so a writer keeps sending the old
+	// one if it changes later, as some orchestrators do to long
+	// running containers; set HostFunc to RefreshedHostname to follow
+	// such changes.
+	HostFunc func() string
+
+	// NoDefaultHost makes the writer send messages without a Host as
+	// they are, instead of filling in the hostname or HostFunc, for
+	// relays that must pass on the host of the original message
+	// verbatim.  Graylog requires the host field and may reject such
+	// messages, so this is for advanced relay setups only; the
+	// messages Write and Log create get no host either.
+	NoDefaultHost bool
+
+	// FullExcludesShort makes Write leave the first line, which is
+	// sent as the short message, out of the full message.  By default
+	// the full message is the complete input.
+	FullExcludesShort bool
+
+	// TraceFunc, when set, is used by WriteMessageContext to look up
+	// the trace and span the context belongs to.  Empty ids are not
+	// sent.
+	TraceFunc func(ctx context.Context) (traceID, spanID string)
+
+	// IntegerTimestamp makes the writer drop the fractional part of
+	// message timestamps, so that they are sent as whole seconds.
+	// Some older Graylog inputs don't parse fractional timestamps.
+	IntegerTimestamp bool
+
+	// AllowedFields, when non-empty, lists the only Extra fields that
+	// are sent, to keep the number of fields in Graylog under control.
+	// Names match with or without the leading underscore, or
+	// FieldPrefix.  Other fields are dropped and counted in
+	// DroppedFields.  This includes fields the Write method adds,
+	// such as _file and _line, but not the RoutingKey field nor
+	// RawExtra, which is sent as is.
+	AllowedFields []string
+
+	// DryRun, when non-nil, receives the JSON encoding of each message
+	// instead of the network, for checking a configuration locally.
+	// Every message is written with a single Write call, as a line
+	// with the compression that would have been used, followed by the
+	// JSON on its own line.
+	DryRun io.Writer
+
+	// AddSequence attaches a number to every message sent, in the
+	// SequenceField, counting up from 1 for the lifetime of the
+	// writer.  Gaps in the numbers of the messages from one host
+	// show that messages were lost on the way.
+	AddSequence bool
+
+	// Source, when non-empty, is attached to every message in the
+	// SourceField, to record the network origin of a message, such
+	// as its address before NAT, apart from the Host identifying the
+	// sender.
+	Source string
+
+	// FieldNames is what to do about Extra field names Graylog
+	// doesn't accept as they are, see ValidFieldName.
+	FieldNames FieldNameMode
+
+	// FieldPrefix, when non-empty, replaces the underscore GELF puts
+	// in front of additional field names, for Graylog pipelines with
+	// a convention of their own.  It is used for the keys passed to
+	// Log, the fields the writer adds itself, such as _appname,
+	// _file and _line, and FieldNames and AllowedFields checks.
+	// Fields named explicitly, in Extra, NewWriterWithData,
+	// RoutingField or by WithTrace, are sent as named; use
+	// FieldNamesSanitize to give them the prefix too.
+	FieldPrefix string
+
+	// AddLevelName attaches the RFC 5424 name of the level of every
+	// message, see LevelName, in the LevelNameField, so that Graylog
+	// can show and filter by it.  The numeric level field is sent
+	// as ever.  Messages with level 0 are sent without level field,
+	// which Graylog takes for 1, so they get no name either.
+	AddLevelName bool
+
+	// Checksum, when not ChecksumNone, attaches a checksum of the full
+	// message of every message that has one, in the ChecksumField, so
+	// that a collector can detect messages truncated or corrupted on
+	// the way, see VerifyChecksum.  The cost grows with the size of
+	// the message and depends on the algorithm, see ChecksumType.
+	// The checksum isn't encrypted: it doesn't protect against
+	// tampering.
+	Checksum ChecksumType
+
+	// StderrFallback makes WriteMessage write messages it fails to
+	// send to the standard error, as a line of JSON each, as a last
+	// resort for container logs to catch them when the network is
+	// down and there is no SpoolWriter.  The error is still returned.
+	// At most 10 lines a second are written, the other messages are
+	// lost as before, so that a long outage doesn't flood the
+	// standard error.
+	StderrFallback bool
+
+	// MaxMessageBytes is the most bytes a message may take up on the
+	// wire, compressed but before being split into chunks.  It
+	// defaults to the most that fits into 128 chunks, the limit of
+	// GELF.  Larger messages make WriteMessage fail, unless
+	// TruncateOversize is set.
+	MaxMessageBytes int
+
+	// TruncateOversize makes WriteMessage cut the full message of
+	// messages larger than MaxMessageBytes short, so that they fit,
+	// rather than fail on them.  Truncated messages have the
+	// TruncatedField set to true.  A message that doesn't fit even
+	// without full message still fails.
+	TruncateOversize bool
+
+	// Times is how time.Duration and time.Time values in Extra are
+	// sent, see TimeFormat.
+	Times TimeFormat
+
+	// FieldTypes, when non-empty, maps Extra field names, without
+	// the leading underscore or FieldPrefix, to the JSON type their
+	// values are sent as, see FieldType.  Graylog stores the messages
+	// in Elasticsearch, whose index takes the type of a field from
+	// the first value it sees and rejects messages with a value of
+	// another type, so fields that vary in type are better fixed.
+	// Values that can't be converted are dropped and counted in
+	// DroppedFields.  This applies after Times.
+	FieldTypes map[string]FieldType
+
+	// StandardFields renames the short_message, full_message,
+	// timestamp and level fields of the messages sent, for inputs
+	// that are like GELF but not quite.  Leave it zero for Graylog.
+	StandardFields StandardFields
+}
+
+// StandardFields renames standard fields in the JSON a Writer sends,
+// for inputs that take GELF with field names of their own.  Each
+// empty name keeps the GELF one.  Graylog only accepts the GELF
+// names, so the zero value is what almost everyone wants.
+type StandardFields struct {
+	Short     string // short_message
+	Full      string // full_message
+	Timestamp string // timestamp
+	Level     string // level
+}
+
+// duplicate returns a field name the names make appear twice in the
+// JSON of a message, or "" if there is none.
+func (names StandardFields) duplicate() string {
+	seen := map[string]bool{"version": true, "host": true, "facility": true}
+	for _, n := range [][2]string{
+		{names.Short, "short_message"},
+		{names.Full, "full_message"},
+		{names.Timestamp, "timestamp"},
+		{names.Level, "level"},
+	} {
+		name := n[0]
+		if name == "" {
+			name = n[1]
+		}
+		if seen[name] {
+			return name
+		}
+		seen[name] = true
+	}
+	return ""
+}
+
+// counters are the counters of a Writer.  They are allocated apart
+// from it, which keeps them 64-bit aligned for atomic access and out of
+// the copy With makes.
+type counters struct {
+	filtered      uint64
+	droppedFields uint64
+	noBuffers     uint64
+	rawBytes      uint64
+	sentBytes     uint64
+}
+
+// link is the connection of a Writer, which it shares with the writers
+// made from it by With, along with the AddSequence numbers.
+type link struct {
+	seq          uint64       // accessed atomically, keep 64-bit aligned
+	mu           sync.RWMutex // guards conn, closed, SetCompression and SetTrafficClass
+	conn         net.Conn
+	closed       bool
+	trafficClass int
+
+	fallbackMu    sync.Mutex // guards the StderrFallback rate limit
+	fallbackStart time.Time
+	fallbackCount int
+}
+
+// FieldNameMode says how a Writer treats invalid additional field names.
+type FieldNameMode int
+
+const (
+	// FieldNamesAsIs sends field names unchanged, leaving Graylog to
+	// rename or drop the invalid ones.
+	FieldNamesAsIs FieldNameMode = iota
+	// FieldNamesReject makes WriteMessage fail on messages with an
+	// invalid field name.
+	FieldNamesReject
+	// FieldNamesSanitize renames invalid fields with
+	// SanitizeFieldName before sending.
+	FieldNamesSanitize
+)
+
+// TimeFormat says how a Writer sends time.Duration and time.Time values
+// in Extra.
+type TimeFormat int
+
+const (
+	// TimesAsIs leaves them to encoding/json, which makes durations
+	// integer nanoseconds and times RFC 3339 strings in their own
+	// time zone.
+	TimesAsIs TimeFormat = iota
+	// TimesUnix sends durations as milliseconds and times as Unix
+	// seconds, both as floating point numbers, which Graylog can
+	// compute with.
+	TimesUnix
+	// TimesRFC3339 sends durations as milliseconds, like TimesUnix,
+	// and times as RFC 3339 strings in UTC, with as many decimals as
+	// needed.
+	TimesRFC3339
+)
+
+// normalize returns v in format f, and whether it is a duration or time
+// at all.
+func (f TimeFormat) normalize(v interface{}) (interface{}, bool) {
+	switch v := v.(type) {
+	case time.Duration:
+		return float64(v) / float64(time.Millisecond), true
+	case time.Time:
+		if f == TimesRFC3339 {
+			return v.UTC().Format(time.RFC3339Nano), true
+		}
+		return float64(v.Unix()) + float64(v.Nanosecond())/float64(time.Second), true
+	}
+	return nil, false
+}
+
+// FieldType is the JSON type a Writer sends the values of a field as,
+// see Writer.FieldTypes.
+type FieldType int
+
+const (
+	// FieldString sends values as strings: numbers and bools as
+	// formatted by fmt, other values other than strings in their
+	// JSON encoding.
+	FieldString FieldType = iota
+	// FieldNumber sends values as numbers: strings are parsed as
+	// floating point numbers, other values that aren't numbers
+	// can't be converted.
+	FieldNumber
+)
+
+// coerce returns v as type t, and whether that was possible.  nil
+// stays nil, as JSON null fits every type.
+func (t FieldType) coerce(v interface{}) (interface{}, bool) {
+	if v == nil {
+		return nil, true
+	}
+	kind := reflect.ValueOf(v).Kind()
+	isNumber := kind >= reflect.Int && kind <= reflect.Float64
+	if _, ok := v.(json.Number); ok {
+		isNumber = true
+	}
+
+	switch t {
+	case FieldString:
+		if s, ok := v.(string); ok {
+			return s, true
+		}
+		if isNumber || kind == reflect.Bool {
+			return fmt.Sprint(v), true
+		}
+		b, err := json.Marshal(v)
+		if err != nil {
+			return nil, false
+		}
+		return string(b), true
+	case FieldNumber:
+		if isNumber {
+			return v, true
+		}
+		if s, ok := v.(string); ok {
+			f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+			return f, err == nil && !math.IsInf(f, 0) && !math.IsNaN(f)
+		}
+	}
+	return nil, false
 }
 
+// UncompressedFromLevel returns a Writer.CompressionFunc sending the
+// messages at level or more severe, numerically less or equal, without
+// compression, and the others compressed with ctype.  Severe messages
+// tend to be few, small and wanted fast, while compressing pays off for
+// the bulk of debug messages.
+func UncompressedFromLevel(level int32, ctype CompressType) func(m *Message) CompressType {
+	return func(m *Message) CompressType {
+		if m.Level <= level {
+			return CompressNone
+		}
+		return ctype
+	}
+}
+
+// SendError describes a message a Writer failed to send, see
+// Writer.OnError.
+type SendError struct {
+	// Message is the message as it was to be sent, with the fields of
+	// the writer applied.  It must not be modified.
+	Message *Message
+	// Size is the size of the message on the wire, compressed, or 0
+	// if it failed before being encoded.
+	Size int
+	// Network and Addr are where the message was sent to, such as
+	// "udp" and the address of the Graylog server.  Addr is nil if
+	// the writer was closed.
+	Network string
+	Addr    net.Addr
+	// Time is when sending failed.
+	Time time.Time
+	// Err is the error WriteMessage returned.
+	Err error
+}
+
+func (e *SendError) Error() string {
+	return fmt.Sprintf("sending %q to %s %s failed: %s", e.Message.Short, e.Network, e.Addr, e.Err)
+}
+
+// Unwrap returns Err.
+func (e *SendError) Unwrap() error {
+	return e.Err
+}
+
+// ErrWriterClosed is returned when writing to a Writer after Close.
+var ErrWriterClosed = errors.New("gelf: writer closed")
+
 // What compression type the writer should use when sending messages
 // to the graylog2 server
 type CompressType int
@@ -43,10 +461,109 @@ const (
 	CompressGzip CompressType = iota
 	CompressZlib
 	CompressNone
+	// CompressAuto picks the compression by the size of each message,
+	// see AutoCompression.
+	CompressAuto
 )
 
+// String returns the name of the compression type.
+func (t CompressType) String() string {
+	switch t {
+	case CompressGzip:
+		return "gzip"
+	case CompressZlib:
+		return "zlib"
+	case CompressNone:
+		return "none"
+	case CompressAuto:
+		return "auto"
+	}
+	return fmt.Sprintf("CompressType(%d)", int(t))
+}
+
+// DefaultLevel returns the level a Writer uses with the compression
+// type: flate.NoCompression for CompressNone, flate.BestSpeed for the
+// others.
+func (t CompressType) DefaultLevel() int {
+	if t == CompressNone {
+		return flate.NoCompression
+	}
+	return flate.BestSpeed
+}
+
+// CompressionConfig is a compression type together with its level.
+// Gzip and zlib are both based on compress/flate and take its levels,
+// from flate.HuffmanOnly to flate.BestCompression; CompressNone takes
+// no level, which is flate.NoCompression.  CompressAuto picks its own
+// levels and ignores Level.
+type CompressionConfig struct {
+	Type  CompressType
+	Level int
+}
+
+// Validate returns an error if Level makes no sense for Type.
+func (c CompressionConfig) Validate() error {
+	switch c.Type {
+	case CompressGzip, CompressZlib:
+		if c.Level < flate.HuffmanOnly || c.Level > flate.BestCompression {
+			return fmt.Errorf("invalid %s compression level %d", c.Type, c.Level)
+		}
+	case CompressNone:
+		if c.Level != flate.NoCompression {
+			return fmt.Errorf("compression level %d set without compression", c.Level)
+		}
+	case CompressAuto:
+	default:
+		return fmt.Errorf("unknown compression type %d", c.Type)
+	}
+	return nil
+}
+
+// AutoCompression holds the payload sizes, in bytes of JSON, at which
+// CompressAuto switches compression: messages smaller than NoneBelow
+// are sent uncompressed, as compressing them saves little, messages of
+// at least BestAbove are gzipped with flate.BestCompression to make
+// them fit into fewer chunks, and the ones in between are gzipped with
+// flate.BestSpeed.  Zero values mean the defaults of 1 KiB and 64 KiB.
+type AutoCompression struct {
+	NoneBelow int
+	BestAbove int
+}
+
+// Pick returns the compression used for a payload of size bytes.
+func (a AutoCompression) Pick(size int) CompressionConfig {
+	noneBelow, bestAbove := a.NoneBelow, a.BestAbove
+	if noneBelow == 0 {
+		noneBelow = 1 << 10
+	}
+	if bestAbove == 0 {
+		bestAbove = 64 << 10
+	}
+	switch {
+	case size < noneBelow:
+		return CompressionConfig{Type: CompressNone, Level: flate.NoCompression}
+	case size >= bestAbove:
+		return CompressionConfig{Type: CompressGzip, Level: flate.BestCompression}
+	}
+	return CompressionConfig{Type: CompressGzip, Level: flate.BestSpeed}
+}
+
+// resolve returns ctype and level, unless ctype is CompressAuto, in
+// which case it picks them for a payload of size bytes.
+func (a AutoCompression) resolve(ctype CompressType, level, size int) (CompressType, int) {
+	if ctype != CompressAuto {
+		return ctype, level
+	}
+	c := a.Pick(size)
+	return c.Type, c.Level
+}
+
 // Message represents the contents of the GELF message.  It is gzipped
 // before sending.
+//
+// Level is authoritative: a "_level" field in Extra, as loggers bridged
+// to GELF sometimes produce, is not sent so that it can't conflict with
+// the level field.  Adapters mapping foreign levels should set Level.
 type Message struct {
 	Version  string                 `json:"version"`
 	Host     string                 `json:"host"`
@@ -57,6 +574,19 @@ type Message struct {
 	Facility string                 `json:"facility,omitempty"`
 	Extra    map[string]interface{} `json:"-"`
 	RawExtra json.RawMessage        `json:"-"`
+
+	// Destination, when non-nil, overrides the address of the Writer
+	// for this message only.  It must be a *net.UDPAddr, and the
+	// Writer must be unconnected, see NewUnconnectedWriter.
+	Destination net.Addr `json:"-"`
+
+	// Compression, when non-nil, overrides the CompressionType of
+	// the Writer for this message only.  It is compressed with the
+	// CompressionLevel of the Writer, or the DefaultLevel of the type
+	// if the Writer doesn't compress.  Point it to CompressNone for
+	// payloads that don't compress, such as base64 encoded binary
+	// data, to skip the compressor whatever the Writer is set to.
+	Compression *CompressType `json:"-"`
 }
 
 // Used to control GELF chunking.  Should be less than (MTU - len(UDP
@@ -66,7 +596,7 @@ type Message struct {
 const (
 	ChunkSize        = 1420
 	chunkedHeaderLen = 12
-	chunkedDataLen   = ChunkSize - chunkedHeaderLen
+	maxChunks        = 128
 )
 
 var (
@@ -75,205 +605,1192 @@ var (
 	magicGzip    = []byte{0x1f, 0x8b}
 )
 
-// Syslog severity levels
-const (
-	LOG_EMERG   = int32(0)
-	LOG_ALERT   = int32(1)
-	LOG_CRIT    = int32(2)
-	LOG_ERR     = int32(3)
-	LOG_WARNING = int32(4)
-	LOG_NOTICE  = int32(5)
-	LOG_INFO    = int32(6)
-	LOG_DEBUG   = int32(7)
-)
+// Syslog severity levels
+const (
+	LOG_EMERG   = int32(0)
+	LOG_ALERT   = int32(1)
+	LOG_CRIT    = int32(2)
+	LOG_ERR     = int32(3)
+	LOG_WARNING = int32(4)
+	LOG_NOTICE  = int32(5)
+	LOG_INFO    = int32(6)
+	LOG_DEBUG   = int32(7)
+)
+
+var levelNames = [...]string{
+	LOG_EMERG:   "EMERGENCY",
+	LOG_ALERT:   "ALERT",
+	LOG_CRIT:    "CRITICAL",
+	LOG_ERR:     "ERROR",
+	LOG_WARNING: "WARNING",
+	LOG_NOTICE:  "NOTICE",
+	LOG_INFO:    "INFO",
+	LOG_DEBUG:   "DEBUG",
+}
+
+// LevelName returns the RFC 5424 name of a syslog severity level, such
+// as "INFO" for LOG_INFO, or "" for levels outside of LOG_EMERG to
+// LOG_DEBUG.
+func LevelName(level int32) string {
+	if level < 0 || int(level) >= len(levelNames) {
+		return ""
+	}
+	return levelNames[level]
+}
+
+// chunkSize returns the size of the largest datagram to send.
+func (w *Writer) chunkSize() int {
+	if w.ChunkSize > 0 {
+		return w.ChunkSize
+	}
+	return ChunkSize
+}
+
+// New returns a new GELF Writer.  This writer can be used to send the
+// output of the standard Go log functions to a central GELF server by
+// passing it to log.SetOutput()
+func NewWriter(addr string, appname string) (*Writer, error) {
+	return newWriter("udp", addr, appname, nil)
+}
+
+// NewWriterWithNetwork is like NewWriter, but sends on the given
+// network: "udp4" or "udp6" to force IPv4 or IPv6, e.g. when the name
+// of a collector listening on IPv4 only also resolves to an IPv6
+// address, or "udp" for either.
+func NewWriterWithNetwork(network, addr string, appname string) (*Writer, error) {
+	if err := checkUDPNetwork(network); err != nil {
+		return nil, err
+	}
+	return newWriter(network, addr, appname, nil)
+}
+
+// checkUDPNetwork returns an error unless network is one of the UDP
+// networks.
+func checkUDPNetwork(network string) error {
+	switch network {
+	case "udp", "udp4", "udp6":
+		return nil
+	}
+	return fmt.Errorf("unsupported network %q, need udp, udp4 or udp6", network)
+}
+
+// newWriter creates a Writer connected to addr on network, through dial
+// if it isn't nil.
+func newWriter(network, addr string, appname string, dial func(addr string) (net.Conn, error)) (*Writer, error) {
+	var err error
+	w := new(Writer)
+	w.counters = new(counters)
+	w.link = new(link)
+	w.CompressionLevel = flate.BestSpeed
+
+	w.network = network
+	w.dial = dial
+	if w.conn, err = w.connect(addr); err != nil {
+		return nil, err
+	}
+	if w.hostname, err = os.Hostname(); err != nil {
+		return nil, err
+	}
+
+	w.optData = map[string]string{
+		"_appname": appname,
+	}
+
+	w.MinLevel = LOG_DEBUG
+
+	w.Facility = path.Base(os.Args[0])
+
+	return w, nil
+}
+
+// NewWriterWithData ccreates an new GELF Writer and adds the entries in OptData as Extra fields.
+// Note that GELF additional field names are supposed to start with an underscore.
+func NewWriterWithData(addr string, appname string, optData map[string]string) (*Writer, error) {
+	w, err := NewWriter(addr, appname)
+	if err != nil {
+		return nil, err
+	}
+	if optData == nil {
+		optData = map[string]string{}
+	}
+	optData["_appname"] = appname
+	w.optData = optData
+
+	return w, nil
+}
+
+// NewWriterWithVerifyOnConnect is like NewWriter, but fails if nothing
+// appears to listen at addr, to catch a misconfigured address at
+// startup.  It checks with Verify, waiting up to timeout, which for UDP
+// is best effort only.
+func NewWriterWithVerifyOnConnect(addr string, appname string, timeout time.Duration) (*Writer, error) {
+	w, err := NewWriter(addr, appname)
+	if err != nil {
+		return nil, err
+	}
+	if err = w.Verify(timeout); err != nil {
+		w.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// NewUnconnectedWriter is like NewWriter, but the writer sends from an
+// unconnected UDP socket, so that single messages can be sent to other
+// collectors than addr by setting their Destination.  Connected
+// sockets, as NewWriter uses, are slightly faster and report more
+// errors, such as ICMP port unreachable, so they remain the default.
+func NewUnconnectedWriter(addr string, appname string) (*Writer, error) {
+	return newWriter("udp", addr, appname, dialUnconnected)
+}
+
+// unconnectedConn is an unconnected UDP socket sending to dst by
+// default.
+type unconnectedConn struct {
+	*net.UDPConn
+	dst *net.UDPAddr
+}
+
+// dialUnconnected returns an unconnectedConn sending to addr.
+func dialUnconnected(addr string) (net.Conn, error) {
+	dst, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("ResolveUDPAddr('%s'): %s", addr, err)
+	}
+	conn, err := net.ListenUDP("udp", nil)
+	if err != nil {
+		return nil, fmt.Errorf("ListenUDP: %s", err)
+	}
+	return &unconnectedConn{UDPConn: conn, dst: dst}, nil
+}
+
+func (c *unconnectedConn) Write(b []byte) (int, error) {
+	return c.WriteToUDP(b, c.dst)
+}
+
+func (c *unconnectedConn) RemoteAddr() net.Addr {
+	return c.dst
+}
+
+// messageID returns the 8 byte id for the next chunked message.
+func (w *Writer) messageID() ([]byte, error) {
+	if w.MessageIDFunc != nil {
+		msgId, err := w.MessageIDFunc()
+		if err != nil {
+			return nil, fmt.Errorf("MessageIDFunc: %s", err)
+		}
+		if len(msgId) != 8 {
+			return nil, fmt.Errorf("MessageIDFunc: got %d byte id, need 8", len(msgId))
+		}
+		return msgId, nil
+	}
+
+	// use urandom to get a unique message id
+	msgId := make([]byte, 8)
+	n, err := io.ReadFull(rand.Reader, msgId)
+	if err != nil || n != 8 {
+		return nil, fmt.Errorf("rand.Reader: %d/%s", n, err)
+	}
+	return msgId, nil
+}
+
+// writes the gzip compressed byte array to the connection as a series
+// of GELF chunked messages, see Chunk for the format.
+func (w *Writer) writeChunked(zBytes []byte, dst *net.UDPAddr) (err error) {
+	msgId, err := w.messageID()
+	if err != nil {
+		return err
+	}
+	chunks, err := Chunk(msgId, zBytes, w.chunkSize())
+	if err != nil {
+		return err
+	}
+
+	nChunks := len(chunks)
+	sent := 0
+	if _, unconnected := w.conn.(*unconnectedConn); dst == nil && !unconnected {
+		// where the platform can, send all chunks in one go, falling
+		// back to single writes, which retry, for the ones that fail;
+		// unconnected sockets need an address per datagram
+		sent, err = writeBatch(w.conn, chunks)
+		w.countNoBuffer(err)
+		if err != nil && err != errNoBatch && !isRetryable(err) {
+			return fmt.Errorf("Write (chunk %d/%d): %s", sent,
+				nChunks, err)
+		}
+	}
+	for i, chunk := range chunks[sent:] {
+		i += sent
+		// write this chunk, and make sure the write was good
+		n, err := w.write(chunk, dst)
+		if err != nil {
+			return fmt.Errorf("Write (chunk %d/%d): %s", i,
+				nChunks, err)
+		}
+		if n != len(chunk) {
+			return fmt.Errorf("Write len: (chunk %d/%d) (%d/%d)",
+				i, nChunks, n, len(chunk))
+		}
+	}
+	return nil
+}
+
+// 1k bytes buffer by default
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return bytes.NewBuffer(make([]byte, 0, 1024))
+	},
+}
+
+func newBuffer() *bytes.Buffer {
+	b := bufPool.Get().(*bytes.Buffer)
+	if b != nil {
+		b.Reset()
+		return b
+	}
+	return bytes.NewBuffer(nil)
+}
+
+// WriteMessage sends the specified message to the GELF server
+// specified in the call to New().  It assumes all the fields are
+// filled out appropriately.  In general, clients will want to use
+// Write, rather than WriteMessage.
+//
+// m is only read: the host and fields the writer adds go into a copy,
+// so the same message may serve as a template for many sends, also
+// concurrently.  The timestamp of m is sent as it is, zero or not, apart
+// from being rounded down with IntegerTimestamp; only the messages
+// Write and Log create get theirs from TimeFunc.
+func (w *Writer) WriteMessage(m *Message) (err error) {
+	if m.Level > w.MinLevel {
+		atomic.AddUint64(&w.filtered, 1)
+		return nil
+	}
+	m = w.prepare(m)
+	var (
+		size int
+		addr net.Addr
+	)
+	if w.OnError != nil {
+		// deferred first, so it runs after the connection is unlocked
+		defer func() {
+			if err != nil {
+				w.OnError(&SendError{
+					Message: m,
+					Size:    size,
+					Network: w.network,
+					Addr:    addr,
+					Time:    time.Now(),
+					Err:     err,
+				})
+			}
+		}()
+	}
+	if w.FieldNames == FieldNamesReject {
+		for k := range m.Extra {
+			if !validFieldName(k, w.prefix()) {
+				return fmt.Errorf("invalid field name %q", k)
+			}
+		}
+	}
+
+	// held until the message is sent, so that SetAddr doesn't close
+	// the connection halfway through
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	dst, err := w.destination(m)
+	if err != nil {
+		return err
+	}
+	if addr = w.conn.RemoteAddr(); dst != nil {
+		addr = dst
+	}
+	ctype, level := w.CompressionType, w.CompressionLevel
+	mtype := m.Compression
+	if mtype == nil && w.CompressionFunc != nil {
+		t := w.CompressionFunc(m)
+		mtype = &t
+	}
+	if mtype != nil && *mtype != ctype {
+		if ctype == CompressNone {
+			// the writer has no level to compress with
+			level = mtype.DefaultLevel()
+		}
+		ctype = *mtype
+	}
+
+	if w.DryRun != nil {
+		return m.dryRun(w.DryRun, ctype, w.AutoCompression, w.StandardFields)
+	}
+
+	mBuf, zBuf := newBuffer(), newBuffer()
+	defer bufPool.Put(mBuf)
+	defer bufPool.Put(zBuf)
+	zBytes, err := m.encode(mBuf, zBuf, ctype, level, w.AutoCompression, w.StandardFields)
+	if err == nil && len(zBytes) > w.maxMessageBytes() {
+		zBytes, err = w.truncate(m, mBuf, zBuf, ctype, level, len(zBytes))
+	}
+	if err != nil {
+		return err
+	}
+
+	size = len(zBytes)
+	if err = w.send(zBytes, dst); err != nil {
+		if w.StderrFallback {
+			w.fallback(mBuf.Bytes())
+		}
+		return err
+	}
+	w.countBytes(mBuf.Len(), len(zBytes))
+	return nil
+}
+
+// countBytes adds a message sent to the byte counts of CompressionStats.
+func (w *Writer) countBytes(raw, sent int) {
+	atomic.AddUint64(&w.rawBytes, uint64(raw))
+	atomic.AddUint64(&w.sentBytes, uint64(sent))
+}
+
+// maxMessageBytes returns MaxMessageBytes, or its default.
+func (w *Writer) maxMessageBytes() int {
+	if w.MaxMessageBytes > 0 {
+		return w.MaxMessageBytes
+	}
+	return maxChunks * (w.chunkSize() - chunkedHeaderLen)
+}
+
+// truncate encodes m again with its full message cut short, so that it
+// fits into maxMessageBytes, if TruncateOversize is set.  size is the
+// size of the complete message.
+func (w *Writer) truncate(m *Message, mBuf, zBuf *bytes.Buffer, ctype CompressType, level, size int) ([]byte, error) {
+	max := w.maxMessageBytes()
+	if !w.TruncateOversize {
+		return nil, fmt.Errorf("message of %d bytes exceeds the maximum of %d", size, max)
+	}
+
+	c := *m
+	c.Extra = make(map[string]interface{}, len(m.Extra)+1)
+	for k, v := range m.Extra {
+		c.Extra[k] = v
+	}
+	c.Extra[w.ownField(TruncatedField)] = true
+	for c.Full != "" {
+		// compression and escaping make the size of the rest only
+		// an estimate, so cut some more and try again if need be
+		keep := int(float64(len(c.Full)) * float64(max) / float64(size) * 0.95)
+		if keep >= len(c.Full) {
+			keep = len(c.Full) - 1
+		}
+		for keep > 0 && !utf8.RuneStart(c.Full[keep]) {
+			keep--
+		}
+		c.Full = c.Full[:keep]
+
+		mBuf.Reset()
+		zBuf.Reset()
+		zBytes, err := c.encode(mBuf, zBuf, ctype, level, w.AutoCompression, w.StandardFields)
+		if err != nil {
+			return nil, err
+		}
+		if size = len(zBytes); size <= max {
+			return zBytes, nil
+		}
+	}
+	return nil, fmt.Errorf("message of %d bytes exceeds the maximum of %d even without full message", size, max)
+}
+
+// fallbackLines is the number of messages per second StderrFallback
+// writes at most.
+const fallbackLines = 10
+
+// fallback writes the JSON encoding of a message that failed to send to
+// the standard error, unless fallbackLines have been written this
+// second already.
+func (w *Writer) fallback(data []byte) {
+	w.fallbackMu.Lock()
+	defer w.fallbackMu.Unlock()
+	now := time.Now()
+	if now.Sub(w.fallbackStart) >= time.Second {
+		w.fallbackStart, w.fallbackCount = now, 0
+	}
+	if w.fallbackCount >= fallbackLines {
+		return
+	}
+	w.fallbackCount++
+
+	line := make([]byte, 0, len(data)+1)
+	line = append(append(line, data...), '\n')
+	os.Stderr.Write(line)
+}
+
+// With returns a child writer that sends over the same connection as w
+// and adds fields to every message, for fields that belong to a request
+// or task, like the With of structured loggers.  Keys are prefixed like
+// those of Log, and the Extra fields of a message win over them.  The
+// child starts out with the configuration w has now, and fields added
+// to w by With.  Changing the configuration of either writer doesn't
+// affect the other, and each has its own counters, such as Filtered,
+// counting from zero.  SetAddr, Reset, SetTrafficClass and Close apply
+// to the shared connection, though, and so to both, and the AddSequence
+// numbers count the messages of both.
+func (w *Writer) With(fields map[string]interface{}) *Writer {
+	c := new(Writer)
+	// SetCompression may be setting the compression of w
+	w.mu.RLock()
+	*c = *w
+	w.mu.RUnlock()
+	c.counters = new(counters)
+
+	// so that changing the maps and slices of either doesn't change
+	// the other
+	c.optData = make(map[string]string, len(w.optData))
+	for k, v := range w.optData {
+		c.optData[k] = v
+	}
+	if w.FieldTypes != nil {
+		c.FieldTypes = make(map[string]FieldType, len(w.FieldTypes))
+		for k, v := range w.FieldTypes {
+			c.FieldTypes[k] = v
+		}
+	}
+	if w.AllowedFields != nil {
+		c.AllowedFields = append([]string(nil), w.AllowedFields...)
+	}
+
+	c.fields = make(map[string]interface{}, len(w.fields)+len(fields))
+	for k, v := range w.fields {
+		c.fields[k] = v
+	}
+	for k, v := range fields {
+		c.fields[c.fieldName(k)] = v
+	}
+	return c
+}
+
+// WriteMessageTo is like WriteMessage, but sends m to addr instead of
+// the writer's address, as if its Destination were addr.  Only writers
+// made with NewUnconnectedWriter can do that, and addr must be a
+// *net.UDPAddr.  m is not modified.
+func (w *Writer) WriteMessageTo(addr net.Addr, m *Message) error {
+	if addr == nil {
+		return errors.New("no destination address")
+	}
+	c := *m
+	c.Destination = addr
+	return w.WriteMessage(&c)
+}
+
+// destination returns the address m overrides the writer's with, if
+// any.
+func (w *Writer) destination(m *Message) (*net.UDPAddr, error) {
+	if m.Destination == nil {
+		return nil, nil
+	}
+	if _, ok := w.conn.(*unconnectedConn); !ok {
+		return nil, fmt.Errorf("destination %s set for a connected writer", m.Destination)
+	}
+	dst, ok := m.Destination.(*net.UDPAddr)
+	if !ok {
+		return nil, fmt.Errorf("destination %s is not a UDP address", m.Destination)
+	}
+	return dst, nil
+}
+
+// WriteRaw sends data, the JSON encoding of a message, as is.  Only
+// compression and chunking are applied; none of the writer's fields or
+// filters are.  It is meant for forwarding messages read with
+// Reader.ReadRaw without decoding them.
+func (w *Writer) WriteRaw(data []byte) error {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+
+	zBuf := newBuffer()
+	defer bufPool.Put(zBuf)
+	ctype, level := w.AutoCompression.resolve(w.CompressionType, w.CompressionLevel, len(data))
+	zBytes, err := compress(data, zBuf, ctype, level)
+	if err != nil {
+		return err
+	}
+
+	if err = w.send(zBytes, nil); err != nil {
+		return err
+	}
+	w.countBytes(len(data), len(zBytes))
+	return nil
+}
+
+// send writes the compressed message zBytes to the connection, as a
+// single datagram or in chunks, and to dst instead of the writer's
+// address if it isn't nil.
+func (w *Writer) send(zBytes []byte, dst *net.UDPAddr) error {
+	if len(zBytes) > w.chunkSize() {
+		return w.writeChunked(zBytes, dst)
+	}
+	n, err := w.write(zBytes, dst)
+	if err != nil {
+		return err
+	}
+	if n != len(zBytes) {
+		return fmt.Errorf("bad write (%d/%d)", n, len(zBytes))
+	}
+
+	return nil
+}
+
+// encode marshals m into mBuf, with the standard fields named by names,
+// and compresses it into zBuf according to ctype and level, or auto for
+// CompressAuto, returning the bytes to send.
+func (m *Message) encode(mBuf, zBuf *bytes.Buffer, ctype CompressType, level int, auto AutoCompression, names StandardFields) ([]byte, error) {
+	if err := m.marshalJSONBuf(mBuf, names); err != nil {
+		return nil, err
+	}
+	ctype, level = auto.resolve(ctype, level, mBuf.Len())
+	return compress(mBuf.Bytes(), zBuf, ctype, level)
+}
+
+// dryRun writes the JSON encoding of m to out, preceded by a comment
+// line naming the compression type ctype, or the one auto picks for
+// CompressAuto.  The standard fields are named by names.
+func (m *Message) dryRun(out io.Writer, ctype CompressType, auto AutoCompression, names StandardFields) error {
+	mBuf, oBuf := newBuffer(), newBuffer()
+	defer bufPool.Put(mBuf)
+	defer bufPool.Put(oBuf)
+	if err := m.marshalJSONBuf(mBuf, names); err != nil {
+		return err
+	}
+	ctype, _ = auto.resolve(ctype, 0, mBuf.Len())
+	fmt.Fprintf(oBuf, "# compression: %s\n", ctype)
+	oBuf.Write(mBuf.Bytes())
+	oBuf.WriteByte('\n')
+	_, err := out.Write(oBuf.Bytes())
+	return err
+}
+
+// compress compresses mBytes into zBuf according to ctype and level,
+// returning the bytes to send.
+func compress(mBytes []byte, zBuf *bytes.Buffer, ctype CompressType, level int) ([]byte, error) {
+	var (
+		zw  io.WriteCloser
+		err error
+	)
+	switch ctype {
+	case CompressGzip:
+		// the header is left zero: no mtime and an unknown OS, so
+		// that identical messages compress to identical bytes
+		zw, err = gzip.NewWriterLevel(zBuf, level)
+	case CompressZlib:
+		zw, err = zlib.NewWriterLevel(zBuf, level)
+	case CompressNone:
+		return mBytes, nil
+	default:
+		return nil, fmt.Errorf("unknown compression type %d", ctype)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if _, err = zw.Write(mBytes); err != nil {
+		zw.Close()
+		return nil, err
+	}
+	if err = zw.Close(); err != nil {
+		return nil, err
+	}
+	return zBuf.Bytes(), nil
+}
+
+// EstimatedSize returns the number of bytes m takes up on the wire when
+// compressed with the given type and level, before being split into
+// chunks.  Fields added by a Writer are not taken into account, and
+// CompressAuto uses the default cutoffs.
+func (m *Message) EstimatedSize(compress CompressType, level int) (int, error) {
+	mBuf, zBuf := newBuffer(), newBuffer()
+	defer bufPool.Put(mBuf)
+	defer bufPool.Put(zBuf)
+	zBytes, err := m.encode(mBuf, zBuf, compress, level, AutoCompression{}, StandardFields{})
+	if err != nil {
+		return 0, err
+	}
+	return len(zBytes), nil
+}
+
+// WriteMessageContext is like WriteMessage, but adds the ids returned
+// by TraceFunc for ctx to the message, unless it already has them.  If
+// ctx carries the start of a request, see WithRequestStart, it also
+// adds the start, in seconds since the Unix epoch like the timestamp,
+// in RequestStartField and the milliseconds elapsed since in
+// ElapsedField, unless the message has those fields already.  The
+// elapsed time is measured with time.Since, on the monotonic clock if
+// start came from time.Now, not with TimeFunc.  m itself is not
+// modified.
+func (w *Writer) WriteMessageContext(ctx context.Context, m *Message) error {
+	cloned := false
+	if w.TraceFunc != nil {
+		traceID, spanID := w.TraceFunc(ctx)
+		if _, ok := m.Extra[TraceIDField]; !ok && traceID != "" {
+			m = m.Clone().WithTrace(traceID, spanID)
+			cloned = true
+		}
+	}
+	if start, ok := RequestStart(ctx); ok {
+		startField, elapsedField := w.ownField(RequestStartField), w.ownField(ElapsedField)
+		_, hasStart := m.Extra[startField]
+		_, hasElapsed := m.Extra[elapsedField]
+		if !hasStart || !hasElapsed {
+			if !cloned {
+				m = m.Clone()
+				if m.Extra == nil {
+					m.Extra = make(map[string]interface{}, 2)
+				}
+			}
+			if !hasStart {
+				m.Extra[startField] = float64(start.Unix()) + float64(start.Nanosecond())/1e9
+			}
+			if !hasElapsed {
+				m.Extra[elapsedField] = float64(time.Since(start)) / float64(time.Millisecond)
+			}
+		}
+	}
+	return w.WriteMessage(m)
+}
+
+// write sends a single datagram, retrying up to RetryCount times with
+// a short backoff while the socket buffer is full.
+func (w *Writer) write(b []byte, dst *net.UDPAddr) (n int, err error) {
+	for attempt := 0; ; attempt++ {
+		if dst != nil {
+			n, err = w.conn.(*unconnectedConn).WriteToUDP(b, dst)
+		} else {
+			n, err = w.conn.Write(b)
+		}
+		w.countNoBuffer(err)
+		if err == nil || attempt >= w.RetryCount || !isRetryable(err) {
+			return n, err
+		}
+		time.Sleep(time.Duration(attempt+1) * 100 * time.Microsecond)
+	}
+}
+
+// errNoBatch is returned by writeBatch when it can't send datagrams in
+// batches on a connection.
+var errNoBatch = errors.New("batch writes not supported")
+
+// countNoBuffer counts err in NoBufferErrors and calls OnNoBuffer if it
+// is ENOBUFS.
+func (w *Writer) countNoBuffer(err error) {
+	if errors.Is(err, errNoBuffers) {
+		atomic.AddUint64(&w.noBuffers, 1)
+		if w.OnNoBuffer != nil {
+			w.OnNoBuffer()
+		}
+	}
+}
+
+// isRetryable reports whether err is a transient error caused by a
+// full socket buffer.
+func isRetryable(err error) bool {
+	return errors.Is(err, errWouldBlock) || errors.Is(err, errNoBuffers)
+}
+
+// prepare returns the message that is actually sent for m, with any
+// writer-level fields applied.  m itself is never modified; a shallow
+// copy is returned instead, which gets its own Extra map as soon as
+// fields are added to it.  If there is nothing to apply, m is returned
+// as is, sparing the allocation of the copy.
+func (w *Writer) prepare(m *Message) *Message {
+	if (m.Host != "" || w.NoDefaultHost) && len(w.fields) == 0 && w.RoutingKey == "" && !w.IntegerTimestamp &&
+		len(w.AllowedFields) == 0 && !w.AddSequence &&
+		w.FieldNames != FieldNamesSanitize && w.Source == "" &&
+		w.FieldPrefix == "" && !w.AddLevelName &&
+		(w.Checksum == ChecksumNone || m.Full == "") && w.Times == TimesAsIs &&
+		len(w.FieldTypes) == 0 {
+		return m
+	}
+
+	c := *m
+	copied := false
+	extra := func() map[string]interface{} {
+		if !copied {
+			c.Extra = make(map[string]interface{}, len(m.Extra)+1)
+			for k, v := range m.Extra {
+				c.Extra[k] = v
+			}
+			copied = true
+		}
+		return c.Extra
+	}
+	setExtra := func(k string, v interface{}) {
+		extra()[k] = v
+	}
+
+	if c.Host == "" && !w.NoDefaultHost {
+		c.Host = w.host()
+	}
+
+	for k, v := range w.fields {
+		if _, ok := m.Extra[k]; !ok {
+			setExtra(k, v)
+		}
+	}
+
+	// the passes below see the fields of With as well
+	if len(w.AllowedFields) > 0 {
+		for k := range c.Extra {
+			if !w.allowedField(k) {
+				delete(extra(), k)
+				atomic.AddUint64(&w.droppedFields, 1)
+			}
+		}
+	}
+
+	if w.FieldPrefix != "" {
+		// Level is authoritative, see Message
+		if _, ok := c.Extra[w.ownField(levelField)]; ok {
+			delete(extra(), w.ownField(levelField))
+		}
+	}
+
+	if w.FieldNames == FieldNamesSanitize {
+		var insane []string
+		for k := range c.Extra {
+			if sanitizeFieldName(k, w.prefix()) != k {
+				insane = append(insane, k)
+			}
+		}
+		for _, k := range insane {
+			v := c.Extra[k]
+			delete(extra(), k)
+			setExtra(sanitizeFieldName(k, w.prefix()), v)
+		}
+	}
+
+	if w.IntegerTimestamp {
+		c.TimeUnix = math.Floor(c.TimeUnix)
+	}
+
+	if w.RoutingKey != "" {
+		field := w.RoutingField
+		if field == "" {
+			field = w.ownField("_stream")
+		}
+		setExtra(field, w.RoutingKey)
+	}
+
+	if w.Source != "" {
+		setExtra(w.ownField(SourceField), w.Source)
+	}
+
+	if w.AddLevelName && c.Level != 0 {
+		if name := LevelName(c.Level); name != "" {
+			setExtra(w.ownField(LevelNameField), name)
+		}
+	}
+
+	if w.Times != TimesAsIs {
+		for k, v := range c.Extra {
+			if n, ok := w.Times.normalize(v); ok {
+				setExtra(k, n)
+			}
+		}
+	}
+
+	if len(w.FieldTypes) > 0 {
+		for k, v := range c.Extra {
+			ft, ok := w.FieldTypes[strings.TrimPrefix(k, w.prefix())]
+			if !ok {
+				continue
+			}
+			if cv, ok := ft.coerce(v); ok {
+				setExtra(k, cv)
+			} else {
+				delete(extra(), k)
+				atomic.AddUint64(&w.droppedFields, 1)
+			}
+		}
+	}
+
+	if w.Checksum != ChecksumNone && c.Full != "" {
+		setExtra(w.ownField(ChecksumField), w.Checksum.Sum(c.Full))
+	}
+
+	if w.AddSequence {
+		setExtra(w.ownField(SequenceField), atomic.AddUint64(&w.seq, 1))
+	}
+
+	return &c
+}
+
+// allowedField reports whether the additional field k is in
+// AllowedFields, ignoring the prefix.
+func (w *Writer) allowedField(k string) bool {
+	k = strings.TrimPrefix(k, w.prefix())
+	for _, allowed := range w.AllowedFields {
+		if strings.TrimPrefix(allowed, w.prefix()) == k {
+			return true
+		}
+	}
+	return false
+}
+
+// now returns the time to stamp the messages the writer creates with.
+func (w *Writer) now() time.Time {
+	if w.TimeFunc != nil {
+		return w.TimeFunc()
+	}
+	return time.Now()
+}
 
-// numChunks returns the number of GELF chunks necessary to transmit
-// the given compressed buffer.
-func numChunks(b []byte) int {
-	lenB := len(b)
-	if lenB <= ChunkSize {
-		return 1
+// host returns the host to send messages without one from.
+func (w *Writer) host() string {
+	if w.HostFunc != nil {
+		return w.HostFunc()
 	}
-	return len(b)/chunkedDataLen + 1
+	return w.hostname
 }
 
-// New returns a new GELF Writer.  This writer can be used to send the
-// output of the standard Go log functions to a central GELF server by
-// passing it to log.SetOutput()
-func NewWriter(addr string, appname string) (*Writer, error) {
-	var err error
-	w := new(Writer)
-	w.CompressionLevel = flate.BestSpeed
+// RefreshedHostname returns a HostFunc reporting the hostname of the
+// machine, read again on the first message after interval has passed
+// since it was last read.  If reading it fails, the last hostname read
+// is kept.  The function is safe for concurrent use.
+func RefreshedHostname(interval time.Duration) func() string {
+	return refreshedHostname(interval, os.Hostname, time.Now)
+}
 
-	if w.conn, err = net.Dial("udp", addr); err != nil {
-		return nil, err
+// refreshedHostname implements RefreshedHostname, with the functions
+// reading the hostname and the time to use.
+func refreshedHostname(interval time.Duration, hostname func() (string, error), now func() time.Time) func() string {
+	var (
+		mu   sync.Mutex
+		name string
+		read time.Time
+	)
+	return func() string {
+		mu.Lock()
+		defer mu.Unlock()
+		if t := now(); read.IsZero() || t.Sub(read) >= interval {
+			if h, err := hostname(); err == nil {
+				name = h
+			}
+			read = t
+		}
+		return name
 	}
-	if w.hostname, err = os.Hostname(); err != nil {
-		return nil, err
+}
+
+// SetCompression sets CompressionType and CompressionLevel together.
+// Unlike assigning the fields, it is safe to call while messages are
+// being written.  The level must be valid for the type, see
+// CompressionConfig.Validate.
+func (w *Writer) SetCompression(t CompressType, level int) error {
+	if err := (CompressionConfig{Type: t, Level: level}).Validate(); err != nil {
+		return err
 	}
 
-	w.optData = map[string]string{
-		"_appname": appname,
+	w.mu.Lock()
+	w.CompressionType, w.CompressionLevel = t, level
+	w.mu.Unlock()
+	return nil
+}
+
+// Compression returns the CompressionType and CompressionLevel of the
+// writer.  Unlike reading the fields, it is safe to call while
+// SetCompression may be called.
+func (w *Writer) Compression() CompressionConfig {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return CompressionConfig{Type: w.CompressionType, Level: w.CompressionLevel}
+}
+
+// Verify checks whether anything listens at the address of the writer,
+// as NewWriterWithVerifyOnConnect does, or after SetAddr, to catch a
+// misconfigured address.  UDP has no handshake, so it sends an empty
+// datagram and waits up to timeout for the host to report the port
+// unreachable.  That makes the check best effort: it fails for a host
+// that is up but has nothing listening on the port, but succeeds if the
+// host or the report is lost on the way, which is told apart from a
+// working collector only by a timeout.  A Reader counts the empty
+// datagram in BadDatagrams.  Writers made with NewUnconnectedWriter get
+// no such reports and can't be verified.
+func (w *Writer) Verify(timeout time.Duration) error {
+	// don't hold the lock while waiting, so that Close, Reset and
+	// SetAddr can go ahead; they close conn, which ends the wait
+	w.mu.RLock()
+	conn, closed := w.conn, w.closed
+	w.mu.RUnlock()
+	if closed {
+		return ErrWriterClosed
+	}
+	if _, ok := conn.(*unconnectedConn); ok {
+		return errors.New("can't verify an unconnected writer")
 	}
 
-	w.Facility = path.Base(os.Args[0])
+	if _, err := conn.Write(nil); err != nil {
+		return fmt.Errorf("%s unreachable: %s", conn.RemoteAddr(), err)
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+		return fmt.Errorf("SetReadDeadline: %s", err)
+	}
+	defer conn.SetReadDeadline(time.Time{})
 
-	return w, nil
+	// nothing is sent back, but a connected socket reports the
+	// unreachable port on the next read
+	var b [1]byte
+	_, err := conn.Read(b[:])
+	switch {
+	case err == nil, errors.Is(err, os.ErrDeadlineExceeded):
+		return nil
+	case errors.Is(err, net.ErrClosed):
+		return errors.New("connection closed while verifying")
+	}
+	return fmt.Errorf("%s unreachable: %s", conn.RemoteAddr(), err)
 }
 
-// NewWriterWithData ccreates an new GELF Writer and adds the entries in OptData as Extra fields.
-// Note that GELF additional field names are supposed to start with an underscore.
-func NewWriterWithData(addr string, appname string, optData map[string]string) (*Writer, error) {
-	w, err := NewWriter(addr, appname)
-	if err != nil {
-		return nil, err
+// SetTrafficClass sets the type of service byte of the IPv4 header, or
+// the traffic class of the IPv6 one, of the datagrams the writer sends,
+// on its connection and those SetAddr and Reset make later.  Its upper
+// six bits are the DSCP, so that the network can tell log traffic apart
+// from application traffic: for example, 8<<2 marks it as low priority
+// (CS1).  A traffic class of 0 is the system default.  Setting it is
+// only supported on the Unix platforms.
+func (w *Writer) SetTrafficClass(tc int) error {
+	if tc < 0 || tc > 255 {
+		return fmt.Errorf("invalid traffic class %d", tc)
 	}
-	if optData == nil {
-		optData = map[string]string{}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrWriterClosed
 	}
-	optData["_appname"] = appname
-	w.optData = optData
+	if err := setTrafficClass(w.conn, tc); err != nil {
+		return err
+	}
+	w.trafficClass = tc
+	return nil
+}
 
-	return w, nil
+// TrafficClass returns the traffic class set with SetTrafficClass.
+func (w *Writer) TrafficClass() int {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.trafficClass
 }
 
-// writes the gzip compressed byte array to the connection as a series
-// of GELF chunked messages.  The format is documented at
-// http://docs.graylog.org/en/2.1/pages/gelf.html as:
-//
-//     2-byte magic (0x1e 0x0f), 8 byte id, 1 byte sequence id, 1 byte
-//     total, chunk-data
-func (w *Writer) writeChunked(zBytes []byte) (err error) {
-	b := make([]byte, 0, ChunkSize)
-	buf := bytes.NewBuffer(b)
-	nChunksI := numChunks(zBytes)
-	if nChunksI > 128 {
-		return fmt.Errorf("msg too large, would need %d chunks", nChunksI)
-	}
-	nChunks := uint8(nChunksI)
-	// use urandom to get a unique message id
-	msgId := make([]byte, 8)
-	n, err := io.ReadFull(rand.Reader, msgId)
-	if err != nil || n != 8 {
-		return fmt.Errorf("rand.Reader: %d/%s", n, err)
-	}
-
-	bytesLeft := len(zBytes)
-	for i := uint8(0); i < nChunks; i++ {
-		buf.Reset()
-		// manually write header.  Don't care about
-		// host/network byte order, because the spec only
-		// deals in individual bytes.
-		buf.Write(magicChunked) //magic
-		buf.Write(msgId)
-		buf.WriteByte(i)
-		buf.WriteByte(nChunks)
-		// slice out our chunk from zBytes
-		chunkLen := chunkedDataLen
-		if chunkLen > bytesLeft {
-			chunkLen = bytesLeft
-		}
-		off := int(i) * chunkedDataLen
-		chunk := zBytes[off : off+chunkLen]
-		buf.Write(chunk)
+// maxDatagram is the largest UDP payload over IPv4.
+const maxDatagram = 65507
 
-		// write this chunk, and make sure the write was good
-		n, err := w.conn.Write(buf.Bytes())
-		if err != nil {
-			return fmt.Errorf("Write (chunk %d/%d): %s", i,
-				nChunks, err)
+// ValidateConfig checks the configuration fields of the writer for
+// values out of bounds or inconsistent with each other, which would
+// otherwise only show up when sending, if at all.  The error lists all
+// problems found.  Call it once the fields are set, e.g. at startup.
+func (w *Writer) ValidateConfig() error {
+	var problems []string
+	add := func(format string, args ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	c := w.Compression()
+	if c.Type == CompressNone {
+		// WriteMessage ignores the level then, and NewWriter sets one
+		c.Level = flate.NoCompression
+	}
+	if err := c.Validate(); err != nil {
+		add("%s", err)
+	}
+	if a := w.AutoCompression; a.NoneBelow < 0 || a.BestAbove < 0 ||
+		(a.NoneBelow > 0 && a.BestAbove > 0 && a.NoneBelow > a.BestAbove) {
+		add("invalid auto compression cutoffs %d and %d", a.NoneBelow, a.BestAbove)
+	}
+	if w.ChunkSize != 0 && (w.ChunkSize <= chunkedHeaderLen || w.ChunkSize > maxDatagram) {
+		add("chunk size %d not between %d and %d", w.ChunkSize, chunkedHeaderLen+1, maxDatagram)
+	}
+	if limit := maxChunks * (w.chunkSize() - chunkedHeaderLen); w.MaxMessageBytes < 0 || w.MaxMessageBytes > limit {
+		add("max message bytes %d not between 0 and %d", w.MaxMessageBytes, limit)
+	}
+	if w.RetryCount < 0 {
+		add("negative retry count %d", w.RetryCount)
+	}
+	if w.MinLevel < LOG_EMERG || w.MinLevel > LOG_DEBUG {
+		add("min level %d not between %d and %d", w.MinLevel, LOG_EMERG, LOG_DEBUG)
+	}
+	if w.FieldNames < FieldNamesAsIs || w.FieldNames > FieldNamesSanitize {
+		add("unknown field name mode %d", w.FieldNames)
+	}
+	if w.Times < TimesAsIs || w.Times > TimesRFC3339 {
+		add("unknown time format %d", w.Times)
+	}
+	for name, ft := range w.FieldTypes {
+		if ft < FieldString || ft > FieldNumber {
+			add("unknown type %d for field %q", ft, name)
 		}
-		if n != len(buf.Bytes()) {
-			return fmt.Errorf("Write len: (chunk %d/%d) (%d/%d)",
-				i, nChunks, n, len(buf.Bytes()))
+	}
+	if w.Checksum < ChecksumNone || w.Checksum > ChecksumSHA256 {
+		add("unknown checksum type %d", w.Checksum)
+	}
+	if name := w.StandardFields.duplicate(); name != "" {
+		add("standard field name %q used twice", name)
+	}
+	if w.RoutingKey != "" && w.RoutingField != "" && !strings.HasPrefix(w.RoutingField, w.prefix()) {
+		add("routing field %q doesn't start with %q", w.RoutingField, w.prefix())
+	}
+	for _, f := range w.AllowedFields {
+		if strings.TrimPrefix(f, w.prefix()) == "" {
+			add("empty allowed field %q", f)
 		}
-
-		bytesLeft -= chunkLen
 	}
 
-	if bytesLeft != 0 {
-		return fmt.Errorf("error: %d bytes left after sending", bytesLeft)
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid writer config: %s", strings.Join(problems, "; "))
 	}
 	return nil
 }
 
-// 1k bytes buffer by default
-var bufPool = sync.Pool{
-	New: func() interface{} {
-		return bytes.NewBuffer(make([]byte, 0, 1024))
-	},
+// Filtered returns the number of messages dropped because their level
+// was less severe than MinLevel.
+func (w *Writer) Filtered() uint64 {
+	return atomic.LoadUint64(&w.filtered)
 }
 
-func newBuffer() *bytes.Buffer {
-	b := bufPool.Get().(*bytes.Buffer)
-	if b != nil {
-		b.Reset()
-		return b
+// DroppedFields returns the number of Extra fields dropped because they
+// were not in AllowedFields or couldn't be converted to their FieldTypes.
+func (w *Writer) DroppedFields() uint64 {
+	return atomic.LoadUint64(&w.droppedFields)
+}
+
+// CompressionStats returns the total size of the messages sent, in
+// their JSON encoding, and the number of bytes that took after
+// compression, not counting the chunk headers.  Comparing them tells
+// what a compression type and level achieve on the actual traffic.
+func (w *Writer) CompressionStats() (raw, compressed uint64) {
+	return atomic.LoadUint64(&w.rawBytes), atomic.LoadUint64(&w.sentBytes)
+}
+
+// CompressionRatio returns the size of the messages sent divided by
+// their size after compression: 4 means they took a quarter of their
+// size on the wire, 1 that they weren't compressed.  It is 0 before any
+// message has been sent.  The two sizes are loaded one after the other,
+// so the ratio is skewed slightly while messages are being sent.
+func (w *Writer) CompressionRatio() float64 {
+	raw, compressed := w.CompressionStats()
+	if compressed == 0 {
+		return 0
 	}
-	return bytes.NewBuffer(nil)
+	return float64(raw) / float64(compressed)
 }
 
-// WriteMessage sends the specified message to the GELF server
-// specified in the call to New().  It assumes all the fields are
-// filled out appropriately.  In general, clients will want to use
-// Write, rather than WriteMessage.
-func (w *Writer) WriteMessage(m *Message) (err error) {
-	mBuf := newBuffer()
-	defer bufPool.Put(mBuf)
-	if err = m.MarshalJSONBuf(mBuf); err != nil {
+// NoBufferErrors returns the number of times sending a datagram failed
+// with ENOBUFS, counting every attempt, see OnNoBuffer.
+func (w *Writer) NoBufferErrors() uint64 {
+	return atomic.LoadUint64(&w.noBuffers)
+}
+
+// Conn returns the connection the writer sends messages over.  It is
+// meant for advanced tuning, such as setting socket options through
+// syscall.RawConn, that the writer does not expose itself.  Reading
+// from, writing to or closing the connection directly bypasses the
+// writer and is the caller's responsibility.
+func (w *Writer) Conn() net.Conn {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	return w.conn
+}
+
+// SetAddr dials addr and makes the writer send all further messages
+// there, closing the previous connection.  The configuration of the
+// writer is kept.  Messages that are being written concurrently are
+// sent completely to either the old or the new address.  If dialing
+// fails, the writer keeps using the previous connection.
+func (w *Writer) SetAddr(addr string) error {
+	conn, err := w.connect(addr)
+	if err != nil {
 		return err
 	}
-	mBytes := mBuf.Bytes()
 
-	var (
-		zBuf   *bytes.Buffer
-		zBytes []byte
-	)
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		conn.Close()
+		return ErrWriterClosed
+	}
+	old := w.conn
+	w.conn = conn
+	w.mu.Unlock()
 
-	var zw io.WriteCloser
-	switch w.CompressionType {
-	case CompressGzip:
-		zBuf = newBuffer()
-		defer bufPool.Put(zBuf)
-		zw, err = gzip.NewWriterLevel(zBuf, w.CompressionLevel)
-	case CompressZlib:
-		zBuf = newBuffer()
-		defer bufPool.Put(zBuf)
-		zw, err = zlib.NewWriterLevel(zBuf, w.CompressionLevel)
-	case CompressNone:
-		zBytes = mBytes
-	default:
-		panic(fmt.Sprintf("unknown compression type %d",
-			w.CompressionType))
+	return old.Close()
+}
+
+// Reset connects the writer to addr like SetAddr, but starts over as if
+// the writer had just been created with its current configuration: it
+// also works after Close, reopening the writer, and sets Filtered,
+// DroppedFields, NoBufferErrors, CompressionStats and the AddSequence
+// numbers back to zero.  It waits for messages that are being
+// written, so it is safe to call at any time.
+func (w *Writer) Reset(addr string) error {
+	conn, err := w.connect(addr)
+	if err != nil {
+		return err
 	}
-	if zw != nil {
-		if err != nil {
-			return
-		}
-		if _, err = zw.Write(mBytes); err != nil {
-			zw.Close()
-			return
-		}
-		zw.Close()
-		zBytes = zBuf.Bytes()
+
+	w.mu.Lock()
+	old, wasClosed := w.conn, w.closed
+	w.conn, w.closed = conn, false
+	atomic.StoreUint64(&w.filtered, 0)
+	atomic.StoreUint64(&w.droppedFields, 0)
+	atomic.StoreUint64(&w.seq, 0)
+	atomic.StoreUint64(&w.noBuffers, 0)
+	atomic.StoreUint64(&w.rawBytes, 0)
+	atomic.StoreUint64(&w.sentBytes, 0)
+	w.mu.Unlock()
+
+	if wasClosed {
+		return nil
 	}
+	return old.Close()
+}
 
-	if numChunks(zBytes) > 1 {
-		return w.writeChunked(zBytes)
+// connect returns a new connection to addr.
+func (w *Writer) connect(addr string) (net.Conn, error) {
+	var (
+		conn net.Conn
+		err  error
+	)
+	if w.dial != nil {
+		conn, err = w.dial(addr)
+	} else {
+		conn, err = net.Dial(w.network, addr)
 	}
-	n, err := w.conn.Write(zBytes)
 	if err != nil {
-		return
-	}
-	if n != len(zBytes) {
-		return fmt.Errorf("bad write (%d/%d)", n, len(zBytes))
+		return nil, err
 	}
 
-	return nil
+	w.mu.RLock()
+	tc := w.trafficClass
+	w.mu.RUnlock()
+	if tc != 0 {
+		if err = setTrafficClass(conn, tc); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
 }
 
-// Close connection and interrupt blocked Read or Write operations
+// Close waits for messages that are being written and closes the
+// connection.  Messages are never buffered, so once Write returned
+// there is nothing left to flush.  Writing to or closing a closed
+// Writer returns ErrWriterClosed.
 func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.closed {
+		return ErrWriterClosed
+	}
+	w.closed = true
 	return w.conn.Close()
 }
 
@@ -325,59 +1842,355 @@ func getCallerIgnoringLogMulti(callDepth int) (string, int) {
 }
 
 // Write encodes the given string in a GELF message and sends it to
-// the server specified in New().
+// the server specified in New().  It returns len(p) and a nil error
+// once the message is sent, and 0 otherwise, so that a Writer can be
+// the destination of io.Copy or the Stdout of an exec.Cmd.  Every
+// call to Write is a message of its own; io.Copy sends each buffer it
+// reads, of up to 32 KiB, as one message.
 func (w *Writer) Write(p []byte) (n int, err error) {
 
 	// 1 for the function that called us.
 	file, line := getCallerIgnoringLogMulti(1)
 
-	// If there are newlines in the message, use the first line
-	// for the short message and set the full message to the
-	// original input.  If the input has no newlines, stick the
-	// whole thing in Short.
-	short := p
-	full := []byte("")
-	if i := bytes.IndexRune(p, '\n'); i > 0 {
+	short, full := splitMessage(p, w.FullExcludesShort)
+	m := w.newMessage(LOG_INFO, string(short), string(full), file, line)
+	if err = w.WriteMessage(m); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// splitMessage derives the short and full message from the input of
+// Write:
+//
+//   - If there are line breaks in the message, the first line is used
+//     for the short message and the full message is set to the
+//     original input, including a trailing line break.  Lines may
+//     end in "\n", "\r\n" or a bare "\r"; Short never contains the
+//     line ending, while Full keeps it unchanged.
+//   - If the input has no line breaks, the whole thing goes in Short
+//     and Full is empty.
+//   - If the input starts with a line break, the first line would be
+//     empty, so the whole input is stuck in Short.  Empty input
+//     results in an empty Short and Full.
+//
+// With excludeShort, Full only holds the lines after the first one,
+// without the line ending of the first line.
+func splitMessage(p []byte, excludeShort bool) (short, full []byte) {
+	short = p
+	full = []byte("")
+	if i := bytes.IndexAny(p, "\r\n"); i > 0 {
 		short = p[:i]
 		full = p
+		if excludeShort {
+			full = p[i+1:]
+			if p[i] == '\r' {
+				full = bytes.TrimPrefix(full, []byte("\n"))
+			}
+		}
+	}
+	return short, full
+}
+
+// Log sends a message with the given level and short message to the
+// server specified in New().  kv holds alternating keys and values
+// that are added as additional fields; keys are prefixed with an
+// underscore unless they already start with one.
+func (w *Writer) Log(level int32, short string, kv ...interface{}) error {
+	if len(kv)%2 != 0 {
+		return fmt.Errorf("odd number of key/value arguments (%d)", len(kv))
+	}
+
+	// 1 for the function that called us.
+	file, line := getCallerIgnoringLogMulti(1)
+
+	m := w.newMessage(level, short, "", file, line)
+	for i := 0; i < len(kv); i += 2 {
+		m.Extra[w.fieldName(fmt.Sprint(kv[i]))] = kv[i+1]
+	}
+
+	return w.WriteMessage(m)
+}
+
+// LogFields is like Log, but takes the additional fields as a map.
+// Keys are prefixed with an underscore unless they already start with
+// one, and are added to the optional data of the writer.  fields itself
+// is not modified.
+func (w *Writer) LogFields(level int32, short string, fields map[string]interface{}) error {
+	// 1 for the function that called us.
+	file, line := getCallerIgnoringLogMulti(1)
+
+	m := w.newMessage(level, short, "", file, line)
+	for k, v := range fields {
+		m.Extra[w.fieldName(k)] = v
+	}
+
+	return w.WriteMessage(m)
+}
+
+// LogStruct is like LogFields, but takes the additional fields from v,
+// as encoding/json marshals it, so json tags name them.  Nested objects
+// are flattened, joining the keys with underscores, so that
+// struct{User struct{ID int}} becomes the field _User_ID.  Values
+// other than objects are sent as the field _value.  If v can't be
+// marshaled, the message is sent without its fields, but with the
+// error in StructErrorField.
+func (w *Writer) LogStruct(level int32, short string, v interface{}) error {
+	// 1 for the function that called us.
+	file, line := getCallerIgnoringLogMulti(1)
+
+	m := w.newMessage(level, short, "", file, line)
+	if err := w.addStruct(m.Extra, v); err != nil {
+		m.Extra[w.ownField(StructErrorField)] = err.Error()
+	}
+
+	return w.WriteMessage(m)
+}
+
+// addStruct adds the flattened fields of v to extra, see LogStruct.
+func (w *Writer) addStruct(extra map[string]interface{}, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var decoded interface{}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber() // keep large integers, such as ids, exact
+	if err = dec.Decode(&decoded); err != nil {
+		return err
+	}
+
+	obj, ok := decoded.(map[string]interface{})
+	if !ok {
+		extra[w.fieldName("value")] = decoded
+		return nil
+	}
+	var flatten func(prefix string, obj map[string]interface{})
+	flatten = func(prefix string, obj map[string]interface{}) {
+		for k, v := range obj {
+			if nested, ok := v.(map[string]interface{}); ok && len(nested) > 0 {
+				flatten(prefix+k+"_", nested)
+				continue
+			}
+			extra[w.fieldName(prefix+k)] = v
+		}
 	}
+	flatten("", obj)
+	return nil
+}
 
-	m := Message{
+// newMessage returns a message originating from file:line, unless file
+// is empty, filled out with the writer's facility and optional data.
+// The host is left for prepare to fill in.
+func (w *Writer) newMessage(level int32, short, full string, file string, line int) *Message {
+	m := &Message{
 		Version:  "1.1",
-		Host:     w.hostname,
-		Short:    string(short),
-		Full:     string(full),
-		TimeUnix: float64(time.Now().Unix()),
-		Level:    6, // info
+		Short:    short,
+		Full:     full,
+		TimeUnix: float64(w.now().Unix()),
+		Level:    level,
 		Facility: w.Facility,
-		Extra: map[string]interface{}{
-			"_file": file,
-			"_line": line,
-		},
+		Extra:    make(map[string]interface{}, len(w.optData)+2),
+	}
+	if file != "" {
+		m.Extra[w.ownField("_file")] = file
+		m.Extra[w.ownField("_line")] = line
 	}
 
 	for k, v := range w.optData {
+		if k == "_appname" {
+			k = w.ownField(k)
+		}
 		m.Extra[k] = v
 	}
 
-	if err = w.WriteMessage(&m); err != nil {
-		return 0, err
+	return m
+}
+
+// prefix returns the prefix of additional field names.
+func (w *Writer) prefix() string {
+	if w.FieldPrefix == "" {
+		return "_"
 	}
+	return w.FieldPrefix
+}
 
-	return len(p), nil
+// fieldName returns key as an additional field name, which has to
+// start with the prefix.
+func (w *Writer) fieldName(key string) string {
+	if strings.HasPrefix(key, w.prefix()) {
+		return key
+	}
+	return w.prefix() + key
+}
+
+// ownField returns the name of a field the writer adds itself, given
+// its GELF name starting with an underscore.
+func (w *Writer) ownField(name string) string {
+	return w.prefix() + name[1:]
+}
+
+// SequenceField is the additional field holding the number of a
+// message, see Writer.AddSequence.
+const SequenceField = "_seq"
+
+// SourceField is the additional field holding Writer.Source.  It isn't
+// "_source", which Graylog would store as the "source" field it derives
+// from the host.
+const SourceField = "_source_ip"
+
+// TruncatedField is the additional field marking messages whose full
+// message was cut short, see Writer.TruncateOversize.
+const TruncatedField = "_truncated"
+
+// LevelNameField is the additional field holding the name of the level
+// of a message, see Writer.AddLevelName.
+const LevelNameField = "_level_name"
+
+// StructErrorField is the additional field holding the error of
+// marshaling the value passed to Writer.LogStruct.
+const StructErrorField = "_struct_error"
+
+// Additional fields holding the start of the request a message belongs
+// to and the milliseconds since, see Writer.WriteMessageContext.
+const (
+	RequestStartField = "_request_start"
+	ElapsedField      = "_elapsed_ms"
+)
+
+// levelField is the additional field that is stripped in favor of
+// Message.Level.
+const levelField = "_level"
+
+// Additional fields used to correlate messages with distributed traces.
+const (
+	TraceIDField = "_trace_id"
+	SpanIDField  = "_span_id"
+)
+
+// ValidFieldName reports whether Graylog accepts name as the name of an
+// additional field unchanged: an underscore followed by at least one
+// letter, digit or underscore, and not the reserved "_id".
+func ValidFieldName(name string) bool {
+	return validFieldName(name, "_")
+}
+
+// validFieldName is ValidFieldName with prefix in place of the
+// underscore.
+func validFieldName(name, prefix string) bool {
+	if !strings.HasPrefix(name, prefix) {
+		return false
+	}
+	rest := name[len(prefix):]
+	if rest == "" || rest == "id" {
+		return false
+	}
+	for i := 0; i < len(rest); i++ {
+		if !isFieldNameByte(rest[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// SanitizeFieldName turns name into a valid field name.  It adds the
+// leading underscore if missing, replaces every character other than
+// ASCII letters, digits and underscores, such as "." and "-", with an
+// underscore, and renames "_id" to "__id".  Distinct names may map to
+// the same field, e.g. "user.id" and "user_id"; only one of them is
+// then sent.
+func SanitizeFieldName(name string) string {
+	return sanitizeFieldName(name, "_")
+}
+
+// sanitizeFieldName is SanitizeFieldName with prefix in place of the
+// leading underscore.
+func sanitizeFieldName(name, prefix string) string {
+	if validFieldName(name, prefix) {
+		return name
+	}
+	name = strings.TrimPrefix(name, prefix)
+	b := make([]byte, 0, len(prefix)+len(name)+1)
+	b = append(b, prefix...)
+	for _, r := range name {
+		if r < utf8.RuneSelf && isFieldNameByte(byte(r)) {
+			b = append(b, byte(r))
+		} else {
+			b = append(b, '_')
+		}
+	}
+	if rest := string(b[len(prefix):]); rest == "" || rest == "id" {
+		b = append(b[:len(prefix)], '_')
+		b = append(b, rest...)
+	}
+	return string(b)
+}
+
+func isFieldNameByte(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// WithTrace sets the trace and span id fields of m and returns m.  An
+// empty spanID is left out.
+func (m *Message) WithTrace(traceID, spanID string) *Message {
+	if m.Extra == nil {
+		m.Extra = make(map[string]interface{}, 2)
+	}
+	m.Extra[TraceIDField] = traceID
+	if spanID != "" {
+		m.Extra[SpanIDField] = spanID
+	}
+	return m
+}
+
+// Clone returns a copy of m that can be modified without affecting m.
+// The Extra map, RawExtra and Compression are copied too; values
+// stored in Extra are not.
+func (m *Message) Clone() *Message {
+	c := *m
+	if m.Extra != nil {
+		c.Extra = make(map[string]interface{}, len(m.Extra))
+		for k, v := range m.Extra {
+			c.Extra[k] = v
+		}
+	}
+	if m.RawExtra != nil {
+		c.RawExtra = append(json.RawMessage(nil), m.RawExtra...)
+	}
+	if m.Compression != nil {
+		compress := *m.Compression
+		c.Compression = &compress
+	}
+	return &c
 }
 
 func (m *Message) MarshalJSONBuf(buf *bytes.Buffer) error {
-	b, err := json.Marshal(m)
-	if err != nil {
+	return m.marshalJSONBuf(buf, StandardFields{})
+}
+
+// marshalJSONBuf is like MarshalJSONBuf, but names the standard fields
+// by names.
+func (m *Message) marshalJSONBuf(buf *bytes.Buffer, names StandardFields) (err error) {
+	// write up until the final }
+	if err = buf.WriteByte('{'); err != nil {
 		return err
 	}
-	// write up until the final }
-	if _, err = buf.Write(b[:len(b)-1]); err != nil {
+	if err = m.writeJSONFields(buf, names); err != nil {
 		return err
 	}
-	if len(m.Extra) > 0 {
-		eb, err := json.Marshal(m.Extra)
+	extra := m.Extra
+	if _, ok := extra[levelField]; ok {
+		// Level is authoritative, don't send a conflicting copy
+		extra = make(map[string]interface{}, len(m.Extra)-1)
+		for k, v := range m.Extra {
+			if k != levelField {
+				extra[k] = v
+			}
+		}
+	}
+	if len(extra) > 0 {
+		eb, err := json.Marshal(extra)
 		if err != nil {
 			return err
 		}
@@ -392,7 +2205,7 @@ func (m *Message) MarshalJSONBuf(buf *bytes.Buffer) error {
 	}
 
 	if len(m.RawExtra) > 0 {
-		if err := buf.WriteByte(','); err != nil {
+		if err = buf.WriteByte(','); err != nil {
 			return err
 		}
 
@@ -412,28 +2225,39 @@ func (m *Message) UnmarshalJSON(data []byte) error {
 		return err
 	}
 	for k, v := range i {
-		if k[0] == '_' {
+		if k != "" && k[0] == '_' {
 			if m.Extra == nil {
 				m.Extra = make(map[string]interface{}, 1)
 			}
 			m.Extra[k] = v
 			continue
 		}
+		if v == nil {
+			continue
+		}
+		var ok bool
 		switch k {
 		case "version":
-			m.Version = v.(string)
+			m.Version, ok = v.(string)
 		case "host":
-			m.Host = v.(string)
+			m.Host, ok = v.(string)
 		case "short_message":
-			m.Short = v.(string)
+			m.Short, ok = v.(string)
 		case "full_message":
-			m.Full = v.(string)
+			m.Full, ok = v.(string)
 		case "timestamp":
-			m.TimeUnix = v.(float64)
+			m.TimeUnix, ok = v.(float64)
 		case "level":
-			m.Level = int32(v.(float64))
+			var level float64
+			level, ok = v.(float64)
+			m.Level = int32(level)
 		case "facility":
-			m.Facility = v.(string)
+			m.Facility, ok = v.(string)
+		default:
+			ok = true
+		}
+		if !ok {
+			return fmt.Errorf("field %s: unexpected type %T", k, v)
 		}
 	}
 	return nil
@@ -5,16 +5,24 @@
 package gelf
 
 import (
+	"bytes"
 	"compress/flate"
+	"context"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 )
 
 func TestNewWriter(t *testing.T) {
@@ -25,6 +33,24 @@ func TestNewWriter(t *testing.T) {
 	}
 }
 
+func TestWriterConn(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	if addr := w.Conn().RemoteAddr().String(); addr != r.Addr() {
+		t.Errorf("Conn().RemoteAddr(): expected %s, got %s", r.Addr(), addr)
+	}
+}
+
 func sendAndRecv(msgData string, compress CompressType) (*Message, error) {
 	r, err := NewReader("127.0.0.1:0")
 	if err != nil {
@@ -87,6 +113,159 @@ func TestWriteSmallMultiLine(t *testing.T) {
 	}
 }
 
+// tests using the Writer as an io.WriteCloser
+func TestWriterCopy(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	var wc io.WriteCloser = w
+
+	n, err := io.Copy(wc, strings.NewReader("copied output"))
+	if err != nil || n != 13 {
+		t.Errorf("io.Copy: copied %d bytes, %v", n, err)
+		return
+	}
+	if err = wc.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+		return
+	}
+
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "copied output" {
+		t.Errorf("msg.Short: expected copied output, got %s", msg.Short)
+	}
+	if _, err = wc.Write([]byte("too late")); err != ErrWriterClosed {
+		t.Errorf("Write after Close: expected ErrWriterClosed, got %v", err)
+	}
+}
+
+// tests that the facility field is left out when Facility is empty
+func TestEmptyFacility(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	if w.Facility == "" {
+		t.Errorf("Facility doesn't default to the process name")
+	}
+	w.Facility = ""
+
+	if _, err = w.Write([]byte("no facility")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	data, _, err := r.ReadRaw()
+	if err != nil {
+		t.Errorf("ReadRaw: %s", err)
+		return
+	}
+	if bytes.Contains(data, []byte(`"facility"`)) {
+		t.Errorf("empty facility was sent: %s", data)
+	}
+}
+
+// tests the derivation of short and full message in Write
+func TestSplitMessage(t *testing.T) {
+	tests := []struct {
+		in, short, full string
+	}{
+		{"", "", ""},
+		{"no newline", "no newline", ""},
+		{"trailing newline\n", "trailing newline", "trailing newline\n"},
+		{"\n", "\n", ""},
+		{"\nleading newline", "\nleading newline", ""},
+		{"first\nsecond\nthird", "first", "first\nsecond\nthird"},
+		{"windows\r\nline endings\r\n", "windows", "windows\r\nline endings\r\n"},
+		{"crlf\r\n", "crlf", "crlf\r\n"},
+		{"bare\rcarriage return", "bare", "bare\rcarriage return"},
+		{"mixed\rline\nendings", "mixed", "mixed\rline\nendings"},
+		{"\r\n", "\r\n", ""},
+	}
+
+	for _, test := range tests {
+		short, full := splitMessage([]byte(test.in), false)
+		if string(short) != test.short {
+			t.Errorf("%q: short: expected %q, got %q", test.in, test.short, short)
+		}
+		if string(full) != test.full {
+			t.Errorf("%q: full: expected %q, got %q", test.in, test.full, full)
+		}
+	}
+}
+
+// tests leaving the short message out of the full message
+func TestSplitMessageFullExcludesShort(t *testing.T) {
+	tests := []struct {
+		in, short, full string
+	}{
+		{"", "", ""},
+		{"no newline", "no newline", ""},
+		{"trailing newline\n", "trailing newline", ""},
+		{"\nleading newline", "\nleading newline", ""},
+		{"first\nsecond\nthird", "first", "second\nthird"},
+		{"windows\r\nline endings\r\n", "windows", "line endings\r\n"},
+		{"bare\rcarriage return", "bare", "carriage return"},
+		{"blank\n\nsecond line", "blank", "\nsecond line"},
+	}
+
+	for _, test := range tests {
+		short, full := splitMessage([]byte(test.in), true)
+		if string(short) != test.short {
+			t.Errorf("%q: short: expected %q, got %q", test.in, test.short, short)
+		}
+		if string(full) != test.full {
+			t.Errorf("%q: full: expected %q, got %q", test.in, test.full, full)
+		}
+	}
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.FullExcludesShort = true
+
+	if _, err = w.Write([]byte("awesomesauce\nbananas")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "awesomesauce" || msg.Full != "bananas" {
+		t.Errorf("expected awesomesauce/bananas, got %q/%q", msg.Short, msg.Full)
+	}
+}
+
 func TestGetCaller(t *testing.T) {
 	file, line := getCallerIgnoringLogMulti(1000)
 	if line != 0 || file != "???" {
@@ -133,6 +312,120 @@ func TestWriteBigChunked(t *testing.T) {
 	}
 }
 
+// tests that chunk headers carry the id from MessageIDFunc
+func TestMessageIDFunc(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("ListenPacket: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	w, err := NewWriter(conn.LocalAddr().String(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.CompressionType = CompressNone
+	id := []byte{1, 2, 3, 4, 5, 6, 7, 8}
+	w.MessageIDFunc = func() ([]byte, error) {
+		return id, nil
+	}
+
+	msgData := strings.Repeat("x", 2*ChunkSize)
+	if _, err = w.Write([]byte(msgData)); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+
+	buf := make([]byte, ChunkSize)
+	for seq := 0; seq < 3; seq++ {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Errorf("ReadFrom: %s", err)
+			return
+		}
+		if n < chunkedHeaderLen {
+			t.Errorf("short chunk: %d bytes", n)
+			return
+		}
+		if !bytes.Equal(buf[:2], magicChunked) {
+			t.Errorf("chunk %d: bad magic %v", seq, buf[:2])
+		}
+		if !bytes.Equal(buf[2:10], id) {
+			t.Errorf("chunk %d: expected id %v, got %v", seq, id, buf[2:10])
+		}
+		if buf[10] != byte(seq) || buf[11] != 3 {
+			t.Errorf("chunk %d: expected sequence %d/3, got %d/%d", seq, seq, buf[10], buf[11])
+		}
+	}
+
+	w.MessageIDFunc = func() ([]byte, error) {
+		return []byte{1, 2, 3}, nil
+	}
+	if _, err = w.Write([]byte(msgData)); err == nil {
+		t.Errorf("w.Write with a 3 byte message id didn't fail")
+	}
+}
+
+// failingConn is a net.Conn whose writes fail with err until fails
+// reaches zero.
+type failingConn struct {
+	net.Conn
+	err    error
+	fails  int
+	writes int
+}
+
+func (c *failingConn) Write(b []byte) (int, error) {
+	c.writes++
+	if c.fails > 0 {
+		c.fails--
+		return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", c.err)}
+	}
+	return c.Conn.Write(b)
+}
+
+// tests that transient write errors are retried RetryCount times
+func TestRetryCount(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	conn := &failingConn{Conn: w.conn, err: errNoBuffers, fails: 2}
+	w.conn = conn
+	w.RetryCount = 2
+
+	if _, err = w.Write([]byte("retried")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	if conn.writes != 3 {
+		t.Errorf("expected 3 writes, got %d", conn.writes)
+	}
+	if msg, err := r.ReadMessage(); err != nil || msg.Short != "retried" {
+		t.Errorf("ReadMessage: %v %v", msg, err)
+		return
+	}
+
+	conn.writes, conn.fails = 0, 3
+	if _, err = w.Write([]byte("dropped")); !errors.Is(err, errNoBuffers) {
+		t.Errorf("expected ENOBUFS after exhausting retries, got %v", err)
+	}
+
+	conn.writes, conn.fails, conn.err = 0, 1, errors.New("connection refused")
+	if _, err = w.Write([]byte("refused")); err == nil || conn.writes != 1 {
+		t.Errorf("non-retryable error: expected 1 failed write, got %d (%v)", conn.writes, err)
+	}
+}
+
 // tests messages with extra data
 func TestExtraData(t *testing.T) {
 
@@ -198,106 +491,2460 @@ func TestExtraData(t *testing.T) {
 	}
 }
 
-func BenchmarkWriteBestSpeed(b *testing.B) {
+// tests sending messages with key/value pairs through Log
+func TestLog(t *testing.T) {
 	r, err := NewReader("127.0.0.1:0")
 	if err != nil {
-		b.Fatalf("NewReader: %s", err)
+		t.Errorf("NewReader: %s", err)
+		return
 	}
-	go io.Copy(ioutil.Discard, r)
-	w, err := NewWriter(r.Addr(), "")
+
+	w, err := NewWriter(r.Addr(), "logtest")
 	if err != nil {
-		b.Fatalf("NewWriter: %s", err)
+		t.Errorf("NewWriter: %s", err)
+		return
 	}
-	w.CompressionLevel = flate.BestSpeed
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		w.WriteMessage(&Message{
-			Version:  "1.1",
-			Host:     w.hostname,
-			Short:    "short message",
-			Full:     "full message",
-			TimeUnix: float64(time.Now().Unix()),
-			Level:    6, // info
-			Facility: w.Facility,
-			Extra:    map[string]interface{}{"_file": "1234", "_line": "3456"},
-		})
+
+	if err = w.Log(LOG_WARNING, "disk almost full", "free", 42, "_mount", "/var"); err != nil {
+		t.Errorf("Log: %s", err)
+		return
 	}
-}
 
-func BenchmarkWriteNoCompression(b *testing.B) {
-	r, err := NewReader("127.0.0.1:0")
+	msg, err := r.ReadMessage()
 	if err != nil {
-		b.Fatalf("NewReader: %s", err)
+		t.Errorf("ReadMessage: %s", err)
+		return
 	}
-	go io.Copy(ioutil.Discard, r)
-	w, err := NewWriter(r.Addr(), "")
-	if err != nil {
-		b.Fatalf("NewWriter: %s", err)
+	if msg.Short != "disk almost full" {
+		t.Errorf("msg.Short: expected disk almost full, got %s", msg.Short)
+		return
 	}
-	w.CompressionLevel = flate.NoCompression
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		w.WriteMessage(&Message{
-			Version:  "1.1",
-			Host:     w.hostname,
-			Short:    "short message",
-			Full:     "full message",
-			TimeUnix: float64(time.Now().Unix()),
-			Level:    6, // info
-			Facility: w.Facility,
-			Extra:    map[string]interface{}{"_file": "1234", "_line": "3456"},
-		})
+	if msg.Level != LOG_WARNING {
+		t.Errorf("msg.Level: expected %d, got %d", LOG_WARNING, msg.Level)
+		return
+	}
+	if msg.Version != "1.1" || msg.Host != w.hostname || msg.TimeUnix == 0 {
+		t.Errorf("standard fields not filled out: %+v", msg)
+		return
+	}
+	if msg.Extra["_free"] != float64(42) || msg.Extra["_mount"] != "/var" {
+		t.Errorf("key/value fields didn't roundtrip: %v", msg.Extra)
+		return
+	}
+	if msg.Extra["_appname"] != "logtest" {
+		t.Errorf("_appname: expected logtest, got %v", msg.Extra["_appname"])
+		return
+	}
+	if file, _ := msg.Extra["_file"].(string); !strings.HasSuffix(file, "/gelf/writer_test.go") {
+		t.Errorf("_file: expected writer_test.go, got %v", msg.Extra["_file"])
+		return
+	}
+
+	if err = w.Log(LOG_INFO, "odd", "key"); err == nil {
+		t.Errorf("Log with odd key/value arguments didn't fail")
+		return
 	}
 }
 
-func BenchmarkWriteDisableCompressionCompletely(b *testing.B) {
+// tests that messages less severe than MinLevel are dropped
+func TestMinLevel(t *testing.T) {
 	r, err := NewReader("127.0.0.1:0")
 	if err != nil {
-		b.Fatalf("NewReader: %s", err)
+		t.Errorf("NewReader: %s", err)
+		return
 	}
-	go io.Copy(ioutil.Discard, r)
+
 	w, err := NewWriter(r.Addr(), "")
 	if err != nil {
-		b.Fatalf("NewWriter: %s", err)
+		t.Errorf("NewWriter: %s", err)
+		return
 	}
-	w.CompressionType = CompressNone
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		w.WriteMessage(&Message{
-			Version:  "1.1",
-			Host:     w.hostname,
-			Short:    "short message",
-			Full:     "full message",
-			TimeUnix: float64(time.Now().Unix()),
-			Level:    6, // info
-			Facility: w.Facility,
-			Extra:    map[string]interface{}{"_file": "1234", "_line": "3456"},
-		})
+	w.MinLevel = LOG_WARNING
+
+	for _, level := range []int32{LOG_DEBUG, LOG_INFO, LOG_NOTICE} {
+		if err = w.Log(level, "dropped"); err != nil {
+			t.Errorf("Log: %s", err)
+			return
+		}
+	}
+	if _, err = w.Write([]byte("dropped")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	if w.Filtered() != 4 {
+		t.Errorf("expected 4 filtered messages, got %d", w.Filtered())
+		return
+	}
+
+	for _, level := range []int32{0, LOG_ERR, LOG_WARNING} {
+		if err = w.Log(level, "sent"); err != nil {
+			t.Errorf("Log: %s", err)
+			return
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Short != "sent" || msg.Level != level {
+			t.Errorf("expected sent at level %d, got %s at %d", level, msg.Short, msg.Level)
+			return
+		}
+	}
+	if w.Filtered() != 4 {
+		t.Errorf("expected 4 filtered messages, got %d", w.Filtered())
 	}
 }
 
-func BenchmarkWriteDisableCompressionAndPreencodeExtra(b *testing.B) {
+// tests that HostFunc supplies the host of messages without one
+func TestHostFunc(t *testing.T) {
 	r, err := NewReader("127.0.0.1:0")
 	if err != nil {
-		b.Fatalf("NewReader: %s", err)
+		t.Errorf("NewReader: %s", err)
+		return
 	}
-	go io.Copy(ioutil.Discard, r)
+
 	w, err := NewWriter(r.Addr(), "")
 	if err != nil {
-		b.Fatalf("NewWriter: %s", err)
+		t.Errorf("NewWriter: %s", err)
+		return
 	}
-	w.CompressionType = CompressNone
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		w.WriteMessage(&Message{
-			Version:  "1.1",
-			Host:     w.hostname,
-			Short:    "short message",
-			Full:     "full message",
-			TimeUnix: float64(time.Now().Unix()),
-			Level:    6, // info
-			Facility: w.Facility,
-			RawExtra: json.RawMessage(`{"_file":"1234","_line": "3456"}`),
-		})
+	calls := 0
+	w.HostFunc = func() string {
+		calls++
+		return fmt.Sprintf("pod-%d", calls)
+	}
+
+	for _, expected := range []string{"pod-1", "pod-2"} {
+		if _, err = w.Write([]byte("dynamic host")); err != nil {
+			t.Errorf("w.Write: %s", err)
+			return
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Host != expected {
+			t.Errorf("msg.Host: expected %s, got %s", expected, msg.Host)
+			return
+		}
+	}
+
+	m := Message{Version: "1.1", Host: "explicit", Short: "static host"}
+	if err = w.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Host != "explicit" || calls != 2 {
+		t.Errorf("msg.Host: expected explicit without calling HostFunc, got %s (%d calls)", msg.Host, calls)
+	}
+}
+
+// tests that RefreshedHostname picks up hostname changes once the
+// interval has passed, and keeps the last name if reading fails
+func TestRefreshedHostname(t *testing.T) {
+	now := time.Unix(1500000000, 0)
+	names := []string{"node-a", "node-b", ""}
+	reads := 0
+	host := refreshedHostname(time.Minute, func() (string, error) {
+		name := names[reads]
+		reads++
+		if name == "" {
+			return "", errors.New("no hostname")
+		}
+		return name, nil
+	}, func() time.Time { return now })
+
+	for _, c := range []struct {
+		after    time.Duration
+		expected string
+		reads    int
+	}{
+		{0, "node-a", 1},
+		{30 * time.Second, "node-a", 1},
+		{30 * time.Second, "node-b", 2},
+		{59 * time.Second, "node-b", 2},
+		{time.Second, "node-b", 3},
+	} {
+		now = now.Add(c.after)
+		if got := host(); got != c.expected || reads != c.reads {
+			t.Errorf("after %s: expected %s with %d reads, got %s with %d", c.after, c.expected, c.reads, got, reads)
+		}
+	}
+}
+
+// tests that a per-message compression type overrides the writer's
+func TestMessageCompression(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.CompressionType = CompressGzip
+
+	for _, i := range []CompressType{CompressGzip, CompressZlib, CompressNone} {
+		compress := i
+		m := Message{
+			Version:     "1.1",
+			Host:        "fake-host",
+			Short:       "compressed per message",
+			TimeUnix:    float64(time.Now().Unix()),
+			Compression: &compress,
+		}
+		if err = w.WriteMessage(&m); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+
+		cBuf, _, err := r.readPayload()
+		if err != nil {
+			t.Errorf("readPayload: %s", err)
+			return
+		}
+		isGzip := bytes.Equal(cBuf[:2], magicGzip)
+		isZlib := cBuf[0] == magicZlib[0]
+		if (i == CompressGzip) != isGzip || (i == CompressZlib) != isZlib {
+			t.Errorf("compression %d: unexpected payload header %v", i, cBuf[:2])
+			return
+		}
+	}
+}
+
+// tests that UncompressedFromLevel sends severe messages uncompressed
+// and the others compressed, and that both decode
+func TestUncompressedFromLevel(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.CompressionType = CompressNone
+	w.CompressionFunc = UncompressedFromLevel(LOG_ERR, CompressZlib)
+
+	for _, level := range []int32{LOG_CRIT, LOG_ERR, LOG_WARNING, LOG_DEBUG} {
+		m := Message{Version: "1.1", Host: "h", Short: "choose by level", Level: level}
+		if err = w.WriteMessage(&m); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+		payload, _, err := r.readPayload()
+		if err != nil {
+			t.Errorf("readPayload: %s", err)
+			return
+		}
+		if compressed := payload[0] == magicZlib[0]; compressed != (level > LOG_ERR) {
+			t.Errorf("level %d: unexpected payload header %v", level, payload[:2])
+		}
+		data, err := decompress(payload)
+		if err != nil {
+			t.Errorf("decompress: %s", err)
+			return
+		}
+		msg, err := decodeMessage(data)
+		if err != nil {
+			t.Errorf("decodeMessage: %s", err)
+			return
+		}
+		if msg.Short != m.Short || msg.Level != level {
+			t.Errorf("level %d: got %+v", level, msg)
+		}
+	}
+
+	none := CompressNone
+	m := Message{Version: "1.1", Host: "h", Short: "own compression", Level: LOG_DEBUG, Compression: &none}
+	if err = w.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	if payload, _, err := r.readPayload(); err != nil || payload[0] != '{' {
+		t.Errorf("expected the message's Compression to win, got %v, %v", payload, err)
+	}
+}
+
+func TestSetCompression(t *testing.T) {
+	w, err := NewWriter("127.0.0.1:12201", "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	if err = w.SetCompression(CompressZlib, flate.BestCompression); err != nil {
+		t.Errorf("SetCompression: %s", err)
+		return
+	}
+	if w.CompressionType != CompressZlib || w.CompressionLevel != flate.BestCompression {
+		t.Errorf("SetCompression: got type %d, level %d", w.CompressionType, w.CompressionLevel)
+		return
+	}
+
+	invalid := []struct {
+		t     CompressType
+		level int
+	}{
+		{CompressGzip, 10},
+		{CompressZlib, -3},
+		{CompressNone, flate.BestSpeed},
+		{CompressType(42), flate.BestSpeed},
+	}
+	for _, c := range invalid {
+		if err = w.SetCompression(c.t, c.level); err == nil {
+			t.Errorf("SetCompression(%d, %d) didn't fail", c.t, c.level)
+		}
+	}
+	if w.CompressionType != CompressZlib || w.CompressionLevel != flate.BestCompression {
+		t.Errorf("failed SetCompression changed type %d, level %d", w.CompressionType, w.CompressionLevel)
+	}
+
+	if err = w.SetCompression(CompressNone, flate.NoCompression); err != nil {
+		t.Errorf("SetCompression: %s", err)
+	}
+	if c := w.Compression(); c.Type != CompressNone || c.Level != flate.NoCompression {
+		t.Errorf("Compression: got type %d, level %d", c.Type, c.Level)
+	}
+}
+
+func TestCompressionConfig(t *testing.T) {
+	valid := []CompressionConfig{
+		{CompressGzip, flate.HuffmanOnly},
+		{CompressGzip, flate.BestCompression},
+		{CompressZlib, flate.DefaultCompression},
+		{CompressNone, flate.NoCompression},
+	}
+	for _, c := range valid {
+		if err := c.Validate(); err != nil {
+			t.Errorf("Validate(%s, %d): %s", c.Type, c.Level, err)
+		}
+	}
+
+	invalid := []CompressionConfig{
+		{CompressGzip, flate.BestCompression + 1},
+		{CompressZlib, flate.HuffmanOnly - 1},
+		{CompressNone, flate.BestSpeed},
+		{CompressType(42), flate.BestSpeed},
+	}
+	for _, c := range invalid {
+		if err := c.Validate(); err == nil {
+			t.Errorf("Validate(%s, %d) didn't fail", c.Type, c.Level)
+		}
+	}
+
+	for _, ct := range []CompressType{CompressGzip, CompressZlib, CompressNone} {
+		c := CompressionConfig{Type: ct, Level: ct.DefaultLevel()}
+		if err := c.Validate(); err != nil {
+			t.Errorf("default level of %s is invalid: %s", ct, err)
+		}
+	}
+}
+
+// tests that CompressAuto picks the compression by message size
+func TestCompressAuto(t *testing.T) {
+	auto := AutoCompression{NoneBelow: 100, BestAbove: 1000}
+	sizes := []struct {
+		size     int
+		expected CompressionConfig
+	}{
+		{99, CompressionConfig{CompressNone, flate.NoCompression}},
+		{100, CompressionConfig{CompressGzip, flate.BestSpeed}},
+		{999, CompressionConfig{CompressGzip, flate.BestSpeed}},
+		{1000, CompressionConfig{CompressGzip, flate.BestCompression}},
+	}
+	for _, c := range sizes {
+		if picked := auto.Pick(c.size); picked != c.expected {
+			t.Errorf("Pick(%d): expected %+v, got %+v", c.size, c.expected, picked)
+		}
+	}
+
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	if err = w.SetCompression(CompressAuto, flate.BestSpeed); err != nil {
+		t.Errorf("SetCompression: %s", err)
+		return
+	}
+
+	for _, short := range []string{"small", strings.Repeat("large ", 300)} {
+		if _, err = w.Write([]byte(short)); err != nil {
+			t.Errorf("w.Write: %s", err)
+			return
+		}
+		cBuf, _, err := r.readPayload()
+		if err != nil {
+			t.Errorf("readPayload: %s", err)
+			return
+		}
+		if isGzip := bytes.Equal(cBuf[:2], magicGzip); isGzip != (short != "small") {
+			t.Errorf("%d byte message: unexpected payload header %v", len(short), cBuf[:2])
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	w, err := NewWriter("127.0.0.1:12201", "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	if err = w.ValidateConfig(); err != nil {
+		t.Errorf("ValidateConfig of the defaults: %s", err)
+		return
+	}
+	// the level NewWriter sets doesn't matter without compression
+	w.CompressionType = CompressNone
+	if err = w.ValidateConfig(); err != nil {
+		t.Errorf("ValidateConfig without compression: %s", err)
+		return
+	}
+
+	w.CompressionType = CompressGzip
+	w.CompressionLevel = 42
+	w.ChunkSize = 100000
+	w.RetryCount = -1
+	w.MinLevel = 8
+	err = w.ValidateConfig()
+	if err == nil {
+		t.Errorf("ValidateConfig of a broken config didn't fail")
+		return
+	}
+	for _, problem := range []string{"compression level 42", "chunk size", "retry count", "min level"} {
+		if !strings.Contains(err.Error(), problem) {
+			t.Errorf("%q not reported in %q", problem, err)
+		}
+	}
+}
+
+// tests switching the address while messages are being written
+func TestSetAddr(t *testing.T) {
+	r1, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r1.Close()
+	r2, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r2.Close()
+	go io.Copy(ioutil.Discard, r1)
+
+	w, err := NewWriter(r1.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.CompressionType = CompressNone
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			w.Write([]byte("concurrent"))
+		}
+	}()
+	if err = w.SetAddr(r2.Addr()); err != nil {
+		t.Errorf("SetAddr: %s", err)
+		return
+	}
+	<-done
+
+	if _, err = w.Write([]byte("moved")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	for {
+		msg, err := r2.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Short == "moved" {
+			break
+		}
+	}
+	if w.CompressionType != CompressNone {
+		t.Errorf("SetAddr changed the compression type")
+	}
+
+	if err = w.SetAddr("not an address"); err == nil {
+		t.Errorf("SetAddr with a bad address didn't fail")
+	}
+}
+
+// tests that writes racing with Close fail cleanly
+// tests that Reset reopens a closed writer and clears its counters
+func TestReset(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter("127.0.0.1:12201", "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.MinLevel = LOG_ERR
+	w.AddSequence = true
+	w.Log(LOG_DEBUG, "filtered")
+	w.Log(LOG_ERR, "numbered")
+	w.Close()
+
+	if err = w.Reset(r.Addr()); err != nil {
+		t.Errorf("Reset: %s", err)
+		return
+	}
+	if w.Filtered() != 0 {
+		t.Errorf("Reset didn't clear Filtered: %d", w.Filtered())
+	}
+	if err = w.Log(LOG_ERR, "after reset"); err != nil {
+		t.Errorf("Log: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "after reset" || msg.Extra[SequenceField] != float64(1) {
+		t.Errorf("expected message 1 after reset, got %s numbered %v", msg.Short, msg.Extra[SequenceField])
+	}
+	if w.MinLevel != LOG_ERR {
+		t.Errorf("Reset changed the configuration")
+	}
+}
+
+// tests that WriteMessage leaves the message alone with every option
+// that adds or changes fields enabled
+func TestWriteMessageReadOnly(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+	go io.Copy(ioutil.Discard, r)
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.RoutingKey = "payments"
+	w.IntegerTimestamp = true
+	w.AllowedFields = []string{"user", "http.status"}
+	w.AddSequence = true
+	w.Source = "10.1.2.3"
+	w.FieldNames = FieldNamesSanitize
+	w.AddLevelName = true
+
+	template := Message{
+		Version:  "1.1",
+		Short:    "template",
+		TimeUnix: 1500000000.5,
+		Level:    LOG_INFO,
+		Extra:    map[string]interface{}{"_user": "alice", "_http.status": 200, "_secret": "x"},
+	}
+	original := template.Clone()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				w.WriteMessage(&template)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if !reflect.DeepEqual(&template, original) {
+		t.Errorf("WriteMessage modified the message: %+v, was %+v", template, *original)
+	}
+}
+
+// tests sending chunked messages through connected writers, which send
+// the chunks in batches where they can, and unconnected ones, with and
+// without a Destination
+func TestWriteChunkedWriters(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+	dst, _ := net.ResolveUDPAddr("udp", r.Addr())
+
+	connected, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	defer connected.Close()
+	unconnected, err := NewUnconnectedWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewUnconnectedWriter: %s", err)
+		return
+	}
+	defer unconnected.Close()
+
+	full := strings.Repeat("x", 5000)
+	for _, c := range []struct {
+		name string
+		w    *Writer
+		dst  net.Addr
+	}{
+		{"connected", connected, nil},
+		{"unconnected", unconnected, nil},
+		{"unconnected with destination", unconnected, dst},
+	} {
+		c.w.CompressionType = CompressNone
+		c.w.ChunkSize = 1000
+		m := Message{Version: "1.1", Host: "h", Short: c.name, Full: full, Destination: c.dst}
+		if err = c.w.WriteMessage(&m); err != nil {
+			t.Errorf("%s: WriteMessage: %s", c.name, err)
+			return
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("%s: ReadMessage: %s", c.name, err)
+			return
+		}
+		if msg.Short != c.name || msg.Full != full {
+			t.Errorf("%s: got %s with %d bytes of full message", c.name, msg.Short, len(msg.Full))
+		}
+	}
+	if n := r.Stats().Reassembled; n != 3 {
+		t.Errorf("expected 3 reassembled messages, got %d", n)
+	}
+}
+
+// tests sending single messages elsewhere from an unconnected writer
+func TestUnconnectedWriter(t *testing.T) {
+	var readers [2]*Reader
+	for i := range readers {
+		r, err := NewReader("127.0.0.1:0")
+		if err != nil {
+			t.Errorf("NewReader: %s", err)
+			return
+		}
+		defer r.Close()
+		readers[i] = r
+	}
+
+	w, err := NewUnconnectedWriter(readers[0].Addr(), "")
+	if err != nil {
+		t.Errorf("NewUnconnectedWriter: %s", err)
+		return
+	}
+	defer w.Close()
+	if w.Conn().RemoteAddr().String() != readers[0].Addr() {
+		t.Errorf("RemoteAddr: expected %s, got %s", readers[0].Addr(), w.Conn().RemoteAddr())
+	}
+
+	dst, _ := net.ResolveUDPAddr("udp", readers[1].Addr())
+	messages := []Message{
+		{Version: "1.1", Host: "h", Short: "elsewhere", Destination: dst},
+		{Version: "1.1", Host: "h", Short: "default"},
+	}
+	for i := range messages {
+		if err = w.WriteMessage(&messages[i]); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+	}
+	for i, expected := range []string{"default", "elsewhere"} {
+		msg, err := readers[i].ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Short != expected {
+			t.Errorf("reader %d: expected %s, got %s", i, expected, msg.Short)
+		}
+	}
+
+	unix := Message{Short: "unix", Destination: &net.UnixAddr{Name: "/dev/log", Net: "unixgram"}}
+	if err = w.WriteMessage(&unix); err == nil {
+		t.Errorf("WriteMessage to a unix address didn't fail")
+	}
+	connected, err := NewWriter(readers[0].Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	if err = connected.WriteMessage(&messages[0]); err == nil {
+		t.Errorf("WriteMessage with a destination on a connected writer didn't fail")
+	}
+}
+
+func TestWriteAfterClose(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+	go io.Copy(ioutil.Discard, r)
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	errs := make(chan error, 400)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if _, err := w.Write([]byte("racing close")); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+	if err = w.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != ErrWriterClosed {
+			t.Errorf("expected ErrWriterClosed, got %v", err)
+			return
+		}
+	}
+
+	if _, err = w.Write([]byte("closed")); err != ErrWriterClosed {
+		t.Errorf("expected ErrWriterClosed, got %v", err)
+	}
+	if err = w.Close(); err != ErrWriterClosed {
+		t.Errorf("second Close: expected ErrWriterClosed, got %v", err)
+	}
+	if err = w.SetAddr(r.Addr()); err != ErrWriterClosed {
+		t.Errorf("SetAddr: expected ErrWriterClosed, got %v", err)
+	}
+}
+
+// tests that EstimatedSize matches what is sent on the wire
+func TestEstimatedSize(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Errorf("ListenPacket: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	w, err := NewWriter(conn.LocalAddr().String(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	m := Message{
+		Version:  "1.1",
+		Host:     "fake-host",
+		Short:    "estimate me",
+		Full:     strings.Repeat("estimate me\n", 20),
+		TimeUnix: 1,
+		Extra:    map[string]interface{}{"_a": 1},
+	}
+
+	buf := make([]byte, ChunkSize)
+	for _, i := range []CompressType{CompressGzip, CompressZlib, CompressNone} {
+		size, err := m.EstimatedSize(i, flate.BestCompression)
+		if err != nil {
+			t.Errorf("EstimatedSize: %s", err)
+			return
+		}
+
+		w.CompressionType = i
+		w.CompressionLevel = flate.BestCompression
+		if err = w.WriteMessage(&m); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Errorf("ReadFrom: %s", err)
+			return
+		}
+		if n != size {
+			t.Errorf("compression %d: estimated %d bytes, sent %d", i, size, n)
+		}
+	}
+
+	if _, err = m.EstimatedSize(CompressType(42), 0); err == nil {
+		t.Errorf("EstimatedSize with unknown compression type didn't fail")
+	}
+}
+
+// tests sending timestamps as whole seconds
+func TestIntegerTimestamp(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.CompressionType = CompressNone
+
+	m := Message{Version: "1.1", Host: "fake-host", Short: "timed", TimeUnix: 1500000000.75}
+	for _, integer := range []bool{false, true} {
+		w.IntegerTimestamp = integer
+		if err = w.WriteMessage(&m); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+
+		data, _, err := r.ReadRaw()
+		if err != nil {
+			t.Errorf("ReadRaw: %s", err)
+			return
+		}
+		expected, timestamp := `"timestamp":1500000000.75`, 1500000000.75
+		if integer {
+			expected, timestamp = `"timestamp":1500000000}`, 1500000000
+		}
+		if !bytes.Contains(data, []byte(expected)) {
+			t.Errorf("expected %s in %s", expected, data)
+		}
+
+		msg, err := decodeMessage(data)
+		if err != nil {
+			t.Errorf("decodeMessage: %s", err)
+			return
+		}
+		if msg.TimeUnix != timestamp {
+			t.Errorf("msg.TimeUnix: expected %v, got %v", timestamp, msg.TimeUnix)
+		}
+	}
+	if m.TimeUnix != 1500000000.75 {
+		t.Errorf("WriteMessage modified the timestamp: %v", m.TimeUnix)
+	}
+}
+
+// tests that DryRun receives the message instead of the network
+func TestDryRun(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	var out bytes.Buffer
+	w.DryRun = &out
+	w.CompressionType = CompressZlib
+
+	m := Message{
+		Version:  "1.1",
+		Host:     "fake-host",
+		Short:    "dry run",
+		TimeUnix: 1500000000,
+	}
+	if err = w.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+
+	expected := "# compression: zlib\n" +
+		`{"version":"1.1","host":"fake-host","short_message":"dry run","timestamp":1500000000}` + "\n"
+	if out.String() != expected {
+		t.Errorf("expected %q, got %q", expected, out.String())
+	}
+	if _, err = r.ReadMessageTimeout(50 * time.Millisecond); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Errorf("expected nothing to be sent, got %v", err)
+	}
+}
+
+// tests that only AllowedFields are sent
+func TestAllowedFields(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.AllowedFields = []string{"user", "_request_id"}
+	w.RoutingKey = "payments"
+
+	m := Message{
+		Version: "1.1",
+		Host:    "fake-host",
+		Short:   "filtered fields",
+		Extra: map[string]interface{}{
+			"_user":       "alice",
+			"_request_id": "42",
+			"_session":    "secret",
+			"_cardinal":   1,
+		},
+	}
+	if err = w.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+
+	if len(msg.Extra) != 3 || msg.Extra["_user"] != "alice" || msg.Extra["_request_id"] != "42" || msg.Extra["_stream"] != "payments" {
+		t.Errorf("expected _user, _request_id and _stream, got %v", msg.Extra)
+	}
+	if w.DroppedFields() != 2 {
+		t.Errorf("expected 2 dropped fields, got %d", w.DroppedFields())
+	}
+	if len(m.Extra) != 4 {
+		t.Errorf("WriteMessage modified the message: %v", m.Extra)
+	}
+}
+
+// tests that AllowedFields and FieldNamesSanitize apply to the fields
+// of With too
+func TestWithAllowedFields(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.AllowedFields = []string{"keep", "user.id"}
+	w.FieldNames = FieldNamesSanitize
+	child := w.With(map[string]interface{}{"secret": "s3cr3t", "keep": 1, "user.id": 7})
+
+	m := Message{Version: "1.1", Host: "h", Short: "with allowed", Extra: map[string]interface{}{"_other": 2}}
+	if err = child.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	expected := map[string]interface{}{"_keep": float64(1), "_user_id": float64(7)}
+	if !reflect.DeepEqual(msg.Extra, expected) {
+		t.Errorf("expected %v, got %v", expected, msg.Extra)
+	}
+	if child.DroppedFields() != 2 {
+		t.Errorf("expected 2 dropped fields, got %d", child.DroppedFields())
+	}
+}
+
+func TestSanitizeFieldName(t *testing.T) {
+	names := map[string]string{
+		"_user_id":         "_user_id",
+		"user.id":          "_user_id",
+		"_http-path":       "_http_path",
+		"_gr\u00fc\u00dfe": "_gr__e",
+		"_id":              "__id",
+		"id":               "__id",
+		"_":                "__",
+		"":                 "__",
+	}
+	for name, expected := range names {
+		if sane := SanitizeFieldName(name); sane != expected {
+			t.Errorf("SanitizeFieldName(%q): expected %q, got %q", name, expected, sane)
+		}
+		if !ValidFieldName(expected) {
+			t.Errorf("ValidFieldName(%q) is false", expected)
+		}
+	}
+}
+
+// tests rejecting and sanitizing invalid field names
+func TestFieldNames(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	m := Message{
+		Version: "1.1",
+		Host:    "fake-host",
+		Short:   "field names",
+		Extra:   map[string]interface{}{"_http.status": 200, "_user": "alice"},
+	}
+	w.FieldNames = FieldNamesReject
+	if err = w.WriteMessage(&m); err == nil {
+		t.Errorf("WriteMessage with an invalid field name didn't fail")
+		return
+	}
+
+	w.FieldNames = FieldNamesSanitize
+	if err = w.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if len(msg.Extra) != 2 || msg.Extra["_http_status"] != float64(200) || msg.Extra["_user"] != "alice" {
+		t.Errorf("expected sanitized fields, got %v", msg.Extra)
+	}
+	if _, ok := m.Extra["_http.status"]; !ok {
+		t.Errorf("WriteMessage modified the message: %v", m.Extra)
+	}
+}
+
+// tests that Source is sent apart from the host
+func TestSource(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.HostFunc = func() string { return "app-7" }
+	w.Source = "10.1.2.3"
+
+	if _, err = w.Write([]byte("from behind NAT")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Host != "app-7" || msg.Extra[SourceField] != "10.1.2.3" {
+		t.Errorf("expected host app-7 from 10.1.2.3, got %s from %v", msg.Host, msg.Extra[SourceField])
+	}
+}
+
+// tests that FieldPrefix replaces the underscore of field names
+func TestFieldPrefix(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.FieldPrefix = "x_"
+	w.AddSequence = true
+	w.FieldNames = FieldNamesReject
+	w.RoutingKey = "payments"
+	if err = w.ValidateConfig(); err != nil {
+		t.Errorf("ValidateConfig: %s", err)
+		return
+	}
+
+	if err = w.Log(LOG_INFO, "prefixed", "user", "alice", "x_level", "info"); err != nil {
+		t.Errorf("Log: %s", err)
+		return
+	}
+	// the Reader only decodes underscore fields
+	data, _, err := r.ReadRaw()
+	if err != nil {
+		t.Errorf("ReadRaw: %s", err)
+		return
+	}
+	var fields map[string]interface{}
+	if err = json.Unmarshal(data, &fields); err != nil {
+		t.Errorf("json.Unmarshal(%q): %s", data, err)
+		return
+	}
+	for _, k := range []string{"x_user", "x_appname", "x_file", "x_line", "x_seq", "x_stream"} {
+		if _, ok := fields[k]; !ok {
+			t.Errorf("field %s missing, got %s", k, data)
+		}
+	}
+	if _, ok := fields["x_level"]; ok {
+		t.Errorf("x_level wasn't stripped: %s", data)
+	}
+
+	m := Message{
+		Version: "1.1",
+		Host:    "fake-host",
+		Short:   "unprefixed",
+		Extra:   map[string]interface{}{"_user": "alice"},
+	}
+	if err = w.WriteMessage(&m); err == nil {
+		t.Errorf("WriteMessage of a field without the prefix didn't fail")
+	}
+}
+
+// tests that AddLevelName attaches the name of the level
+func TestAddLevelName(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.AddLevelName = true
+
+	if err = w.Log(LOG_WARNING, "named level"); err != nil {
+		t.Errorf("Log: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Level != LOG_WARNING || msg.Extra[LevelNameField] != "WARNING" {
+		t.Errorf("expected level 4 named WARNING, got %d named %v", msg.Level, msg.Extra[LevelNameField])
+	}
+
+	if LevelName(LOG_EMERG) != "EMERGENCY" || LevelName(LOG_DEBUG) != "DEBUG" || LevelName(8) != "" || LevelName(-1) != "" {
+		t.Errorf("unexpected level names")
+	}
+}
+
+// tests that AddSequence numbers messages concurrently written
+func TestAddSequence(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.AddSequence = true
+
+	const n = 10
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w.Write([]byte("numbered"))
+		}()
+	}
+	wg.Wait()
+
+	seen := make(map[float64]bool)
+	for i := 0; i < n; i++ {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		seq, _ := msg.Extra[SequenceField].(float64)
+		seen[seq] = true
+	}
+	for i := 1; i <= n; i++ {
+		if !seen[float64(i)] {
+			t.Errorf("sequence number %d is missing, got %v", i, seen)
+		}
+	}
+}
+
+// tests that RoutingKey is attached to every message
+func TestRoutingKey(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.RoutingKey = "payments"
+
+	if _, err = w.Write([]byte("routed")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Extra["_stream"] != "payments" {
+		t.Errorf("_stream: expected payments, got %v", msg.Extra["_stream"])
+		return
+	}
+
+	w.RoutingField = "_route"
+	m := Message{
+		Version:  "1.1",
+		Host:     "fake-host",
+		Short:    "routed",
+		TimeUnix: float64(time.Now().Unix()),
+	}
+	if err = w.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	msg, err = r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Extra["_route"] != "payments" {
+		t.Errorf("_route: expected payments, got %v", msg.Extra["_route"])
+		return
+	}
+	if m.Extra != nil {
+		t.Errorf("WriteMessage modified the message: %v", m.Extra)
+		return
+	}
+}
+
+func TestMessageClone(t *testing.T) {
+	compress := CompressZlib
+	m := Message{
+		Version:     "1.1",
+		Host:        "fake-host",
+		Short:       "original",
+		Extra:       map[string]interface{}{"_a": 1},
+		RawExtra:    json.RawMessage(`{"_b":2}`),
+		Compression: &compress,
+	}
+
+	c := m.Clone()
+	c.Short = "clone"
+	c.Extra["_a"] = 2
+	c.Extra["_c"] = 3
+	c.RawExtra[len(c.RawExtra)-2] = '3'
+	*c.Compression = CompressNone
+
+	if m.Short != "original" || m.Extra["_a"] != 1 || len(m.Extra) != 1 {
+		t.Errorf("modifying the clone changed the original: %+v", m)
+	}
+	if string(m.RawExtra) != `{"_b":2}` {
+		t.Errorf("modifying the clone changed RawExtra: %s", m.RawExtra)
+	}
+	if *m.Compression != CompressZlib {
+		t.Errorf("modifying the clone changed Compression: %d", *m.Compression)
+	}
+
+	empty := (&Message{Short: "no extra"}).Clone()
+	if empty.Extra != nil || empty.RawExtra != nil || empty.Compression != nil {
+		t.Errorf("clone of a message without extra fields has some: %+v", empty)
+	}
+}
+
+type traceKey struct{}
+
+// tests that WriteMessageContext attaches trace ids from TraceFunc
+func TestWriteMessageContext(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.TraceFunc = func(ctx context.Context) (string, string) {
+		ids, _ := ctx.Value(traceKey{}).([2]string)
+		return ids[0], ids[1]
+	}
+
+	ctx := context.WithValue(context.Background(), traceKey{}, [2]string{"4bf92f3577b34da6a3ce929d0e0e4736", "00f067aa0ba902b7"})
+	m := Message{Version: "1.1", Host: "fake-host", Short: "traced"}
+	if err = w.WriteMessageContext(ctx, &m); err != nil {
+		t.Errorf("WriteMessageContext: %s", err)
+		return
+	}
+	if m.Extra != nil {
+		t.Errorf("WriteMessageContext modified the message: %v", m.Extra)
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Extra[TraceIDField] != "4bf92f3577b34da6a3ce929d0e0e4736" || msg.Extra[SpanIDField] != "00f067aa0ba902b7" {
+		t.Errorf("trace ids not attached: %v", msg.Extra)
+	}
+
+	// explicit ids win over the context, no ids in the context add none
+	m.WithTrace("explicit", "")
+	for _, ctx := range []context.Context{ctx, context.Background()} {
+		if err = w.WriteMessageContext(ctx, &m); err != nil {
+			t.Errorf("WriteMessageContext: %s", err)
+			return
+		}
+		msg, err = r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Extra[TraceIDField] != "explicit" || msg.Extra[SpanIDField] != nil {
+			t.Errorf("expected only the explicit trace id, got %v", msg.Extra)
+		}
+	}
+}
+
+// tests that WriteMessageContext adds the request start and the time
+// elapsed since, without them if the context has no start, and that
+// TimeFunc doesn't change the elapsed time
+func TestWriteMessageContextRequestStart(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.TimeFunc = func() time.Time { return time.Unix(1500000000, 0) }
+
+	start := time.Now().Add(-1250 * time.Millisecond)
+	startUnix := float64(start.Unix()) + float64(start.Nanosecond())/1e9
+	ctx := WithRequestStart(context.Background(), start)
+	for _, c := range []struct {
+		ctx     context.Context
+		extra   map[string]interface{}
+		start   interface{}
+		elapsed float64 // at least, 0 if none
+	}{
+		{ctx, nil, startUnix, 1250},
+		{ctx, map[string]interface{}{ElapsedField: 3}, startUnix, 3},
+		{context.Background(), nil, nil, 0},
+	} {
+		m := Message{Version: "1.1", Host: "h", Short: "request done", Extra: c.extra}
+		if err = w.WriteMessageContext(c.ctx, &m); err != nil {
+			t.Errorf("WriteMessageContext: %s", err)
+			return
+		}
+		if len(m.Extra) != len(c.extra) {
+			t.Errorf("WriteMessageContext modified the message: %v", m.Extra)
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Extra[RequestStartField] != c.start {
+			t.Errorf("expected start %v, got %v", c.start, msg.Extra[RequestStartField])
+		}
+		elapsed, _ := msg.Extra[ElapsedField].(float64)
+		if c.elapsed == 0 && msg.Extra[ElapsedField] != nil || elapsed < c.elapsed || elapsed > c.elapsed+10000 {
+			t.Errorf("expected %v ms elapsed at least, got %v", c.elapsed, msg.Extra[ElapsedField])
+		}
+	}
+}
+
+// singleConn hides that a connection is a socket, so that chunks are
+// sent one write at a time.
+type singleConn struct {
+	net.Conn
+}
+
+// compares sending the chunks of large messages in batches, where the
+// platform supports that, with sending them one at a time
+func BenchmarkWriteChunked(b *testing.B) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("ListenPacket: %s", err)
+	}
+	defer conn.Close()
+	go func() {
+		buf := make([]byte, ChunkSize)
+		for {
+			if _, _, err := conn.ReadFrom(buf); err != nil {
+				return
+			}
+		}
+	}()
+
+	m := &Message{
+		Version:  "1.1",
+		Host:     "h",
+		Short:    "large message",
+		Full:     strings.Repeat("x", 16*ChunkSize),
+		TimeUnix: 1500000000,
+		Level:    6, // info
+	}
+	for _, batched := range []bool{true, false} {
+		name := "single"
+		if batched {
+			name = "batched"
+		}
+		b.Run(name, func(b *testing.B) {
+			w, err := NewWriter(conn.LocalAddr().String(), "")
+			if err != nil {
+				b.Fatalf("NewWriter: %s", err)
+			}
+			defer w.Close()
+			w.CompressionType = CompressNone
+			if !batched {
+				w.conn = singleConn{w.conn}
+			}
+
+			b.SetBytes(int64(len(m.Full)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if err := w.WriteMessage(m); err != nil {
+					b.Fatalf("WriteMessage: %s", err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkWriteBestSpeed(b *testing.B) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("NewReader: %s", err)
+	}
+	go io.Copy(ioutil.Discard, r)
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		b.Fatalf("NewWriter: %s", err)
+	}
+	w.CompressionLevel = flate.BestSpeed
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.WriteMessage(&Message{
+			Version:  "1.1",
+			Host:     w.hostname,
+			Short:    "short message",
+			Full:     "full message",
+			TimeUnix: float64(time.Now().Unix()),
+			Level:    6, // info
+			Facility: w.Facility,
+			Extra:    map[string]interface{}{"_file": "1234", "_line": "3456"},
+		})
+	}
+}
+
+func BenchmarkWriteNoCompression(b *testing.B) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("NewReader: %s", err)
+	}
+	go io.Copy(ioutil.Discard, r)
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		b.Fatalf("NewWriter: %s", err)
+	}
+	w.CompressionLevel = flate.NoCompression
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.WriteMessage(&Message{
+			Version:  "1.1",
+			Host:     w.hostname,
+			Short:    "short message",
+			Full:     "full message",
+			TimeUnix: float64(time.Now().Unix()),
+			Level:    6, // info
+			Facility: w.Facility,
+			Extra:    map[string]interface{}{"_file": "1234", "_line": "3456"},
+		})
+	}
+}
+
+func BenchmarkWriteDisableCompressionCompletely(b *testing.B) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("NewReader: %s", err)
+	}
+	go io.Copy(ioutil.Discard, r)
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		b.Fatalf("NewWriter: %s", err)
+	}
+	w.CompressionType = CompressNone
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.WriteMessage(&Message{
+			Version:  "1.1",
+			Host:     w.hostname,
+			Short:    "short message",
+			Full:     "full message",
+			TimeUnix: float64(time.Now().Unix()),
+			Level:    6, // info
+			Facility: w.Facility,
+			Extra:    map[string]interface{}{"_file": "1234", "_line": "3456"},
+		})
+	}
+}
+
+func BenchmarkWriteDisableCompressionAndPreencodeExtra(b *testing.B) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		b.Fatalf("NewReader: %s", err)
+	}
+	go io.Copy(ioutil.Discard, r)
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		b.Fatalf("NewWriter: %s", err)
+	}
+	w.CompressionType = CompressNone
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w.WriteMessage(&Message{
+			Version:  "1.1",
+			Host:     w.hostname,
+			Short:    "short message",
+			Full:     "full message",
+			TimeUnix: float64(time.Now().Unix()),
+			Level:    6, // info
+			Facility: w.Facility,
+			RawExtra: json.RawMessage(`{"_file":"1234","_line": "3456"}`),
+		})
+	}
+}
+
+// tests that Checksum attaches a checksum a collector can verify
+func TestChecksum(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	for _, c := range []struct {
+		ctype ChecksumType
+		sum   string
+	}{
+		{ChecksumCRC32, "3c555f18"},
+		{ChecksumSHA256, "e5a1cb2e33a5e467781820a6cbe4c7f25254a448300060066a253f52baee37e0"},
+	} {
+		w.Checksum = c.ctype
+		if err = w.WriteMessage(&Message{Version: "1.1", Short: "check", Full: "check me"}); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Extra[ChecksumField] != c.sum {
+			t.Errorf("%s: expected %s, got %v", c.ctype, c.sum, msg.Extra[ChecksumField])
+		}
+		if !VerifyChecksum(msg) {
+			t.Errorf("%s: VerifyChecksum failed", c.ctype)
+		}
+		msg.Full = "check"
+		if VerifyChecksum(msg) {
+			t.Errorf("%s: VerifyChecksum of a truncated message succeeded", c.ctype)
+		}
+	}
+
+	if err = w.WriteMessage(&Message{Version: "1.1", Short: "no full message"}); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if _, ok := msg.Extra[ChecksumField]; ok {
+		t.Errorf("checksum sent without full message: %v", msg.Extra)
+	}
+}
+
+// tests that NoDefaultHost leaves an empty host empty
+func TestNoDefaultHost(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.NoDefaultHost = true
+
+	for _, host := range []string{"", "origin"} {
+		if err = w.WriteMessage(&Message{Version: "1.1", Host: host, Short: "relayed"}); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+		data, _, err := r.ReadRaw()
+		if err != nil {
+			t.Errorf("ReadRaw: %s", err)
+			return
+		}
+		var raw map[string]interface{}
+		if err = json.Unmarshal(data, &raw); err != nil {
+			t.Errorf("json.Unmarshal: %s", err)
+			return
+		}
+		if raw["host"] != host {
+			t.Errorf("expected host %q, got %v", host, raw["host"])
+		}
+	}
+}
+
+// noBufferConn fails the first writes with ENOBUFS, like a busy network
+// interface.
+type noBufferConn struct {
+	net.Conn
+	failures int
+}
+
+func (c *noBufferConn) Write(b []byte) (int, error) {
+	if c.failures > 0 {
+		c.failures--
+		return 0, &net.OpError{Op: "write", Net: "udp", Err: os.NewSyscallError("write", errNoBuffers)}
+	}
+	return c.Conn.Write(b)
+}
+
+// tests that ENOBUFS errors are counted and reported to OnNoBuffer
+func TestNoBufferErrors(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := newWriter("udp", r.Addr(), "", func(addr string) (net.Conn, error) {
+		conn, err := net.Dial("udp", addr)
+		return &noBufferConn{Conn: conn, failures: 3}, err
+	})
+	if err != nil {
+		t.Errorf("newWriter: %s", err)
+		return
+	}
+	calls := 0
+	w.OnNoBuffer = func() { calls++ }
+	w.RetryCount = 1
+
+	if _, err = w.Write([]byte("dropped")); !errors.Is(err, errNoBuffers) {
+		t.Errorf("expected ENOBUFS, got %v", err)
+	}
+	if _, err = w.Write([]byte("retried")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "retried" {
+		t.Errorf("expected the retried message, got %s", msg.Short)
+	}
+	if w.NoBufferErrors() != 3 || calls != 3 {
+		t.Errorf("expected 3 ENOBUFS errors, counted %d and called %d times", w.NoBufferErrors(), calls)
+	}
+}
+
+// tests that OnError gets the details of failed messages only
+func TestOnError(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := newWriter("udp", r.Addr(), "", func(addr string) (net.Conn, error) {
+		conn, err := net.Dial("udp", addr)
+		return &noBufferConn{Conn: conn, failures: 1}, err
+	})
+	if err != nil {
+		t.Errorf("newWriter: %s", err)
+		return
+	}
+	var errs []*SendError
+	w.OnError = func(e *SendError) { errs = append(errs, e) }
+	w.CompressionType = CompressNone
+
+	m := Message{Version: "1.1", Host: "h", Short: "lost", Extra: map[string]interface{}{"_id": 1}}
+	if err = w.WriteMessage(&m); !errors.Is(err, errNoBuffers) {
+		t.Errorf("expected ENOBUFS, got %v", err)
+	}
+	if err = w.WriteMessage(&Message{Version: "1.1", Host: "h", Short: "sent"}); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	w.Close()
+	if err = w.WriteMessage(&m); err != ErrWriterClosed {
+		t.Errorf("expected ErrWriterClosed, got %v", err)
+	}
+
+	if len(errs) != 2 {
+		t.Errorf("expected 2 errors, got %d", len(errs))
+		return
+	}
+	e := errs[0]
+	if e.Message.Short != "lost" || !errors.Is(e, errNoBuffers) || e.Network != "udp" ||
+		e.Addr == nil || e.Addr.String() != r.Addr() || e.Time.IsZero() {
+		t.Errorf("unexpected error details: %+v", e)
+	}
+	var buf bytes.Buffer
+	if e.Message.MarshalJSONBuf(&buf); e.Size != buf.Len() {
+		t.Errorf("expected size %d, got %d", buf.Len(), e.Size)
+	}
+	if errs[1].Err != ErrWriterClosed || errs[1].Size != 0 {
+		t.Errorf("unexpected error details: %+v", errs[1])
+	}
+}
+
+// tests that StandardFields renames the standard fields in the output
+func TestStandardFields(t *testing.T) {
+	w, err := NewWriter("127.0.0.1:12201", "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	var out bytes.Buffer
+	w.DryRun = &out
+	w.StandardFields = StandardFields{Short: "message", Timestamp: "@timestamp", Level: "severity"}
+
+	m := Message{Version: "1.1", Host: "h", Short: "renamed", Full: "in full", TimeUnix: 1500000000, Level: LOG_ERR}
+	if err = w.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	expected := `{"version":"1.1","host":"h","message":"renamed","full_message":"in full","@timestamp":1500000000,"severity":3}`
+	if lines := strings.Split(out.String(), "\n"); len(lines) < 2 || lines[1] != expected {
+		t.Errorf("expected %s, got %s", expected, out.String())
+	}
+
+	w.StandardFields.Full = "message"
+	if err = w.ValidateConfig(); err == nil || !strings.Contains(err.Error(), `"message" used twice`) {
+		t.Errorf("expected a duplicate name reported, got %v", err)
+	}
+}
+
+// tests routing messages to several collectors with WriteMessageTo
+func TestWriteMessageTo(t *testing.T) {
+	var readers [2]*Reader
+	for i := range readers {
+		r, err := NewReader("127.0.0.1:0")
+		if err != nil {
+			t.Errorf("NewReader: %s", err)
+			return
+		}
+		defer r.Close()
+		readers[i] = r
+	}
+
+	w, err := NewUnconnectedWriter(readers[0].Addr(), "")
+	if err != nil {
+		t.Errorf("NewUnconnectedWriter: %s", err)
+		return
+	}
+	defer w.Close()
+
+	m := Message{Version: "1.1", Host: "h"}
+	for i := len(readers) - 1; i >= 0; i-- {
+		addr, _ := net.ResolveUDPAddr("udp", readers[i].Addr())
+		m.Short = fmt.Sprintf("to reader %d", i)
+		if err = w.WriteMessageTo(addr, &m); err != nil {
+			t.Errorf("WriteMessageTo: %s", err)
+			return
+		}
+	}
+	if m.Destination != nil {
+		t.Errorf("WriteMessageTo modified the message: %v", m.Destination)
+	}
+	for i, r := range readers {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if expected := fmt.Sprintf("to reader %d", i); msg.Short != expected {
+			t.Errorf("reader %d: expected %s, got %s", i, expected, msg.Short)
+		}
+	}
+
+	if err = w.WriteMessageTo(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 12201}, &m); err == nil {
+		t.Errorf("WriteMessageTo a TCP address didn't fail")
+	}
+	if err = w.WriteMessageTo(nil, &m); err == nil {
+		t.Errorf("WriteMessageTo without address didn't fail")
+	}
+	connected, err := NewWriter(readers[0].Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	addr, _ := net.ResolveUDPAddr("udp", readers[1].Addr())
+	if err = connected.WriteMessageTo(addr, &m); err == nil {
+		t.Errorf("WriteMessageTo on a connected writer didn't fail")
+	}
+}
+
+func TestContext(t *testing.T) {
+	w, err := NewWriter("127.0.0.1:12201", "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	if _, ok := FromContext(context.Background()); ok {
+		t.Errorf("FromContext found a writer in an empty context")
+	}
+	ctx := NewContext(context.Background(), w)
+	if got, ok := FromContext(ctx); !ok || got != w {
+		t.Errorf("FromContext: expected %p, got %p", w, got)
+	}
+	if _, ok := FromContext(NewContext(ctx, nil)); ok {
+		t.Errorf("FromContext found a nil writer")
+	}
+}
+
+// tests that child writers made by With add their own fields
+func TestWith(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.AddSequence = true
+	child := w.With(map[string]interface{}{"request_id": "r-1", "_user": "alice"})
+	grandchild := child.With(map[string]interface{}{"step": 2})
+	child.MinLevel = LOG_ERR
+
+	if child.Conn() != w.Conn() {
+		t.Errorf("child writer doesn't share the connection")
+	}
+	if err = w.Log(LOG_INFO, "parent"); err != nil {
+		t.Errorf("Log: %s", err)
+		return
+	}
+	if err = child.Log(LOG_INFO, "filtered by the child only"); err != nil {
+		t.Errorf("Log: %s", err)
+		return
+	}
+	if err = child.WriteMessage(&Message{Version: "1.1", Short: "child", Level: LOG_ERR, Extra: map[string]interface{}{"_user": "bob"}}); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	if err = grandchild.Log(LOG_INFO, "grandchild"); err != nil {
+		t.Errorf("Log: %s", err)
+		return
+	}
+
+	expected := []map[string]interface{}{
+		{},
+		{"_request_id": "r-1", "_user": "bob"},
+		{"_request_id": "r-1", "_user": "alice", "_step": float64(2)},
+	}
+	for i, fields := range expected {
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		for _, k := range []string{"_request_id", "_user", "_step"} {
+			if msg.Extra[k] != fields[k] {
+				t.Errorf("%s: expected %s %v, got %v", msg.Short, k, fields[k], msg.Extra[k])
+			}
+		}
+		if msg.Extra[SequenceField] != float64(i+1) {
+			t.Errorf("%s: expected sequence number %d, got %v", msg.Short, i+1, msg.Extra[SequenceField])
+		}
+	}
+	if w.Filtered() != 0 || child.Filtered() != 1 {
+		t.Errorf("expected only the child to filter, got %d and %d", w.Filtered(), child.Filtered())
+	}
+}
+
+// tests that the maps and slices of the configuration aren't shared
+// with the writers made by With
+func TestWithCopiesConfig(t *testing.T) {
+	w, err := NewWriterWithData("127.0.0.1:12201", "app", map[string]string{"_env": "prod"})
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.FieldTypes = map[string]FieldType{"_n": FieldNumber}
+	w.AllowedFields = []string{"_n"}
+	child := w.With(nil)
+
+	w.FieldTypes["_n"] = FieldString
+	w.FieldTypes["_m"] = FieldNumber
+	w.AllowedFields[0] = "_m"
+	w.optData["_env"] = "dev"
+
+	if len(child.FieldTypes) != 1 || child.FieldTypes["_n"] != FieldNumber {
+		t.Errorf("child FieldTypes changed with the parent's: %v", child.FieldTypes)
+	}
+	if child.AllowedFields[0] != "_n" {
+		t.Errorf("child AllowedFields changed with the parent's: %v", child.AllowedFields)
+	}
+	if child.optData["_env"] != "prod" {
+		t.Errorf("child data changed with the parent's: %v", child.optData)
+	}
+
+	// for the race detector
+	done := make(chan bool)
+	go func() {
+		w.SetCompression(CompressZlib, flate.BestCompression)
+		close(done)
+	}()
+	w.With(nil)
+	<-done
+}
+
+// tests that StderrFallback writes a limited number of failed messages
+// to the standard error
+func TestStderrFallback(t *testing.T) {
+	stderr, err := ioutil.TempFile("", "stderr")
+	if err != nil {
+		t.Errorf("TempFile: %s", err)
+		return
+	}
+	defer os.Remove(stderr.Name())
+	defer stderr.Close()
+	defer func(orig *os.File) { os.Stderr = orig }(os.Stderr)
+	os.Stderr = stderr
+
+	w, err := newWriter("udp", "127.0.0.1:12201", "", func(addr string) (net.Conn, error) {
+		conn, err := net.Dial("udp", addr)
+		return &noBufferConn{Conn: conn, failures: 1000}, err
+	})
+	if err != nil {
+		t.Errorf("newWriter: %s", err)
+		return
+	}
+	w.StderrFallback = true
+
+	for i := 0; i < fallbackLines+5; i++ {
+		m := Message{Version: "1.1", Host: "h", Short: fmt.Sprintf("lost %d", i)}
+		if err = w.WriteMessage(&m); err == nil {
+			t.Errorf("WriteMessage didn't fail")
+			return
+		}
+	}
+
+	data, err := ioutil.ReadFile(stderr.Name())
+	if err != nil {
+		t.Errorf("ReadFile: %s", err)
+		return
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != fallbackLines {
+		t.Errorf("expected %d lines, got %d", fallbackLines, len(lines))
+		return
+	}
+	var m Message
+	if err = json.Unmarshal([]byte(lines[0]), &m); err != nil {
+		t.Errorf("json.Unmarshal: %s", err)
+		return
+	}
+	if m.Short != "lost 0" {
+		t.Errorf("expected the first message, got %s", m.Short)
+	}
+}
+
+// tests that TruncateOversize cuts the full message of large messages
+func TestTruncateOversize(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.CompressionType = CompressNone
+	w.MaxMessageBytes = 500
+
+	full := strings.Repeat("über long ", 200)
+	m := Message{Version: "1.1", Host: "h", Short: "oversize", Full: full}
+	if err = w.WriteMessage(&m); err == nil {
+		t.Errorf("WriteMessage of an oversize message didn't fail")
+		return
+	}
+
+	w.TruncateOversize = true
+	if err = w.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	data, _, err := r.ReadRaw()
+	if err != nil {
+		t.Errorf("ReadRaw: %s", err)
+		return
+	}
+	if len(data) > w.MaxMessageBytes {
+		t.Errorf("expected at most %d bytes, got %d", w.MaxMessageBytes, len(data))
+	}
+	var msg Message
+	if err = json.Unmarshal(data, &msg); err != nil {
+		t.Errorf("json.Unmarshal: %s", err)
+		return
+	}
+	if msg.Full == "" || !strings.HasPrefix(full, msg.Full) || !utf8.ValidString(msg.Full) {
+		t.Errorf("unexpected truncated full message %q", msg.Full)
+	}
+	if msg.Extra[TruncatedField] != true {
+		t.Errorf("expected %s set, got %v", TruncatedField, msg.Extra)
+	}
+	if m.Full != full || m.Extra != nil {
+		t.Errorf("WriteMessage modified the message")
+	}
+
+	m.Short = strings.Repeat("s", 1000)
+	if err = w.WriteMessage(&m); err == nil {
+		t.Errorf("WriteMessage of a message too large without full message didn't fail")
+	}
+}
+
+func TestLogFields(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriterWithData(r.Addr(), "logtest", map[string]string{"_env": "prod"})
+	if err != nil {
+		t.Errorf("NewWriterWithData: %s", err)
+		return
+	}
+
+	fields := map[string]interface{}{"free": 42, "_mount": "/var"}
+	if err = w.LogFields(LOG_WARNING, "disk almost full", fields); err != nil {
+		t.Errorf("LogFields: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Short != "disk almost full" || msg.Level != LOG_WARNING || msg.Host != w.hostname {
+		t.Errorf("standard fields not filled out: %+v", msg)
+	}
+	for k, v := range map[string]interface{}{"_free": float64(42), "_mount": "/var", "_env": "prod", "_appname": "logtest"} {
+		if msg.Extra[k] != v {
+			t.Errorf("%s: expected %v, got %v", k, v, msg.Extra[k])
+		}
+	}
+	if file, _ := msg.Extra["_file"].(string); !strings.HasSuffix(file, "/gelf/writer_test.go") {
+		t.Errorf("_file: expected writer_test.go, got %v", msg.Extra["_file"])
+	}
+	if _, ok := fields["_free"]; ok || len(fields) != 2 {
+		t.Errorf("LogFields modified the fields: %v", fields)
+	}
+}
+
+// tests that LogStruct flattens the JSON of a struct into fields
+func TestLogStruct(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	// the flattened names must be valid
+	w.FieldNames = FieldNamesReject
+
+	type user struct {
+		ID   int64  `json:"id"`
+		Name string `json:"name,omitempty"`
+	}
+	order := struct {
+		Number string `json:"number"`
+		User   user   `json:"user"`
+		Items  []int  `json:"items"`
+		secret string
+	}{"A-17", user{ID: 7}, []int{1, 2}, "hidden"}
+
+	for _, c := range []struct {
+		v        interface{}
+		expected map[string]interface{}
+	}{
+		{order, map[string]interface{}{
+			"_number": "A-17", "_user_id": float64(7), "_items": []interface{}{float64(1), float64(2)},
+		}},
+		{42, map[string]interface{}{"_value": float64(42)}},
+		{make(chan int), map[string]interface{}{"_struct_error": "json: unsupported type: chan int"}},
+	} {
+		if err = w.LogStruct(LOG_INFO, "order placed", c.v); err != nil {
+			t.Errorf("LogStruct: %s", err)
+			return
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		delete(msg.Extra, "_file")
+		delete(msg.Extra, "_line")
+		delete(msg.Extra, "_appname")
+		if !reflect.DeepEqual(msg.Extra, c.expected) {
+			t.Errorf("expected %v, got %v", c.expected, msg.Extra)
+		}
+	}
+}
+
+// tests that CompressionStats adds up the sizes of the messages sent
+func TestCompressionStats(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	if w.CompressionRatio() != 0 {
+		t.Errorf("expected ratio 0 before sending, got %f", w.CompressionRatio())
+	}
+
+	var raw, compressed uint64
+	for _, ctype := range []CompressType{CompressNone, CompressGzip, CompressZlib} {
+		w.CompressionType = ctype
+		for i := 1; i <= 3; i++ {
+			m := Message{Version: "1.1", Host: "h", Short: "ratio", Full: strings.Repeat("compressible ", 50*i)}
+			if err = w.WriteMessage(&m); err != nil {
+				t.Errorf("WriteMessage: %s", err)
+				return
+			}
+			cBuf, _, err := r.readPayload()
+			if err != nil {
+				t.Errorf("readPayload: %s", err)
+				return
+			}
+			data, err := decompress(cBuf)
+			if err != nil {
+				t.Errorf("decompress: %s", err)
+				return
+			}
+			raw += uint64(len(data))
+			compressed += uint64(len(cBuf))
+		}
+
+		gotRaw, gotCompressed := w.CompressionStats()
+		if gotRaw != raw || gotCompressed != compressed {
+			t.Errorf("%s: expected %d and %d bytes, got %d and %d", ctype, raw, compressed, gotRaw, gotCompressed)
+		}
+		if ratio := float64(raw) / float64(compressed); w.CompressionRatio() != ratio {
+			t.Errorf("%s: expected ratio %f, got %f", ctype, ratio, w.CompressionRatio())
+		}
+		if ctype == CompressNone && w.CompressionRatio() != 1 {
+			t.Errorf("expected ratio 1 without compression, got %f", w.CompressionRatio())
+		}
+	}
+	if w.CompressionRatio() < 2 {
+		t.Errorf("expected repetitive messages to compress, got ratio %f", w.CompressionRatio())
+	}
+}
+
+// tests sending durations and times in each TimeFormat
+func TestTimes(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	at := time.Date(2017, 7, 14, 4, 40, 0, 250000000, time.FixedZone("CEST", 2*3600))
+	m := Message{
+		Version: "1.1",
+		Host:    "h",
+		Short:   "timed",
+		Extra:   map[string]interface{}{"_took": 1500 * time.Microsecond, "_at": at, "_n": 3},
+	}
+	for _, c := range []struct {
+		format   TimeFormat
+		took, at interface{}
+	}{
+		{TimesAsIs, float64(1500000), "2017-07-14T04:40:00.25+02:00"},
+		{TimesUnix, 1.5, 1500000000.25},
+		{TimesRFC3339, 1.5, "2017-07-14T02:40:00.25Z"},
+	} {
+		w.Times = c.format
+		if err = w.WriteMessage(&m); err != nil {
+			t.Errorf("WriteMessage: %s", err)
+			return
+		}
+		msg, err := r.ReadMessage()
+		if err != nil {
+			t.Errorf("ReadMessage: %s", err)
+			return
+		}
+		if msg.Extra["_took"] != c.took || msg.Extra["_at"] != c.at || msg.Extra["_n"] != float64(3) {
+			t.Errorf("format %d: expected %v and %v, got %v", c.format, c.took, c.at, msg.Extra)
+		}
+	}
+	if _, ok := m.Extra["_took"].(time.Duration); !ok {
+		t.Errorf("WriteMessage modified the message: %v", m.Extra)
+	}
+}
+
+// tests that FieldTypes coerces values and drops those it can't
+func TestFieldTypes(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	w.FieldTypes = map[string]FieldType{
+		"count": FieldNumber,
+		"id":    FieldString,
+		"tags":  FieldString,
+		"bad":   FieldNumber,
+	}
+
+	m := Message{
+		Version: "1.1",
+		Host:    "h",
+		Short:   "typed",
+		Extra: map[string]interface{}{
+			"_count": " 42 ",
+			"_id":    12345,
+			"_tags":  []string{"a", "b"},
+			"_bad":   "many",
+			"_other": "7",
+		},
+	}
+	if err = w.WriteMessage(&m); err != nil {
+		t.Errorf("WriteMessage: %s", err)
+		return
+	}
+	msg, err := r.ReadMessage()
+	if err != nil {
+		t.Errorf("ReadMessage: %s", err)
+		return
+	}
+	if msg.Extra["_count"] != float64(42) || msg.Extra["_id"] != "12345" ||
+		msg.Extra["_tags"] != `["a","b"]` || msg.Extra["_other"] != "7" {
+		t.Errorf("unexpected fields: %v", msg.Extra)
+	}
+	if _, ok := msg.Extra["_bad"]; ok {
+		t.Errorf("expected _bad to be dropped: %v", msg.Extra)
+	}
+	if w.DroppedFields() != 1 {
+		t.Errorf("expected 1 dropped field, got %d", w.DroppedFields())
+	}
+	if m.Extra["_count"] != " 42 " {
+		t.Errorf("WriteMessage modified the message: %v", m.Extra)
+	}
+}
+
+func TestVerify(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	if err = w.Verify(50 * time.Millisecond); err != nil {
+		t.Errorf("Verify with a listening reader: %s", err)
+	}
+	if _, err = w.Write([]byte("still works")); err != nil {
+		t.Errorf("w.Write: %s", err)
+		return
+	}
+	if msg, err := r.ReadMessage(); err != nil || msg.Short != "still works" {
+		t.Errorf("ReadMessage after Verify: %v, %v", msg, err)
+	}
+
+	// nothing listens on the port of a closed reader
+	closed, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	closed.Close()
+	w, err = NewWriter(closed.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+	if err = w.Verify(time.Second); err == nil {
+		t.Errorf("Verify with nothing listening didn't fail")
+	}
+
+	if w, err = NewWriterWithVerifyOnConnect(r.Addr(), "", 50*time.Millisecond); err != nil {
+		t.Errorf("NewWriterWithVerifyOnConnect with a listening reader: %s", err)
+		return
+	}
+	w.Close()
+	if _, err = NewWriterWithVerifyOnConnect(closed.Addr(), "", time.Second); err == nil {
+		t.Errorf("NewWriterWithVerifyOnConnect with nothing listening didn't fail")
+	}
+}
+
+// tests that Close doesn't wait for Verify
+func TestVerifyClose(t *testing.T) {
+	r, err := NewReader("127.0.0.1:0")
+	if err != nil {
+		t.Errorf("NewReader: %s", err)
+		return
+	}
+	defer r.Close()
+	w, err := NewWriter(r.Addr(), "")
+	if err != nil {
+		t.Errorf("NewWriter: %s", err)
+		return
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- w.Verify(10 * time.Second)
+	}()
+	// let Verify start waiting
+	time.Sleep(50 * time.Millisecond)
+	start := time.Now()
+	if err = w.Close(); err != nil {
+		t.Errorf("Close: %s", err)
+		return
+	}
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("Close waited %s for Verify", d)
+	}
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Errorf("Verify didn't return after Close")
 	}
 }
@@ -1,3 +1,7 @@
 module github.com/nimbusec-oss/go-gelf
 
 go 1.17
+
+require go.opentelemetry.io/otel/trace v1.10.0
+
+require go.opentelemetry.io/otel v1.10.0 // indirect